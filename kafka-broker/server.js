@@ -4,6 +4,7 @@ const sqlite3 = require("sqlite3").verbose();
 const app = express();
 const request = require("request-promise");
 const cors = require("cors");
+const crypto = require("crypto");
 const base_url = process.env.BASE_URL || "http://localhost";
 
 app.use(cors());
@@ -62,12 +63,13 @@ app.post("/addScore", (req, res) => {
     z_ports = z_ports.filter(port => port !== assignedPort);
   }
 
-  sendRequest(assignedPort || z_ports.shift(), incomingScore, z_ports, res)
+  const firstPort = assignedPort || z_ports.shift();
+  sendRequest(firstPort, incomingScore, z_ports, res)
       .then(response => {
-        res.sendStatus(200);
+        respondCommitted(res, response);
       })
       .catch(error => {
-        handleRequestError(assignedPort, incomingScore, z_ports, res);
+        handleRequestError(firstPort, incomingScore, z_ports, res, error);
       });
 });
 
@@ -81,6 +83,8 @@ function getAssignedPort(req) {
 function createIncomingScore(req, assignedPort) {
   const currentTimestamp = new Date().toISOString();
   return {
+    // Same RequestId on every retry, so ZooWeeper does not commit the same score twice
+    RequestId: (req.body && req.body.requestId) || `${port}-${crypto.randomUUID()}`,
     Timestamp: currentTimestamp,
     Metadata: {
       SenderIp: port,
@@ -122,8 +126,49 @@ function sendRequest(currentPort, incomingScore, availablePorts, res) {
 }
 
 
-function handleRequestError(failedPort, incomingScore, availablePorts, res) {
-  console.log("Failed on port:", failedPort);
+// Pass the committed zxid on, so a reader can ask any ZooWeeper server for at least this zxid (X-Min-Zxid)
+function respondCommitted(res, response) {
+  if (response && response.data && response.data.zxid !== undefined) {
+    res.set("X-Zxid", String(response.data.zxid));
+  }
+  res.sendStatus(200);
+}
+
+// ZooWeeper replies with a structured error, e.g. 503 PROPOSAL_TIMEOUT when the Leader could not reach a quorum
+function getZooWeeperError(error) {
+  if (error && error.statusCode && error.error && error.error.code) {
+    return { status: error.statusCode, body: error.error };
+  }
+  return undefined;
+}
+
+// A leadership transfer or change is over within a few seconds, the same port is retried with a growing delay
+const LEADER_RETRY_DELAY_MS = parseInt(process.env.LEADER_RETRY_DELAY_MS, 10) || 1000;
+const LEADER_RETRIES = 5;
+
+function isLeaderChange(zooWeeperError) {
+  return zooWeeperError !== undefined && zooWeeperError.status === 503 &&
+      ["LEADER_TRANSFER", "LEADER_CHANGED"].includes(zooWeeperError.body.code);
+}
+
+function handleRequestError(failedPort, incomingScore, availablePorts, res, error, leaderRetries = 0) {
+  const zooWeeperError = getZooWeeperError(error);
+  console.log("Failed on port:", failedPort, zooWeeperError ? zooWeeperError.body.code : "");
+
+  if (isLeaderChange(zooWeeperError) && leaderRetries < LEADER_RETRIES) {
+    const delay = LEADER_RETRY_DELAY_MS * (leaderRetries + 1);
+    console.log(`Leadership changing, retrying port ${failedPort} in ${delay}ms`);
+    setTimeout(() => {
+      sendRequest(failedPort, incomingScore, availablePorts, res)
+          .then(response => {
+            respondCommitted(res, response);
+          })
+          .catch(error => {
+            handleRequestError(failedPort, incomingScore, availablePorts, res, error, leaderRetries + 1);
+          });
+    }, delay);
+    return;
+  }
   availablePorts = availablePorts.filter(port => port !== failedPort);
 
   if (availablePorts.length > 0) {
@@ -132,11 +177,14 @@ function handleRequestError(failedPort, incomingScore, availablePorts, res) {
 
     sendRequest(nextPort, incomingScore, availablePorts, res)
         .then(response => {
-          res.sendStatus(200);
+          respondCommitted(res, response);
         })
         .catch(error => {
-          handleRequestError(nextPort, incomingScore, availablePorts, res);
+          handleRequestError(nextPort, incomingScore, availablePorts, res, error);
         });
+  } else if (zooWeeperError) {
+    console.log("No more ports to try.");
+    res.status(zooWeeperError.status).send(zooWeeperError.body);
   } else {
     console.log("No more ports to try.");
     res.status(500).send("Internal Server Error");
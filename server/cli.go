@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"github.com/tnbl265/zooweeper/ztree"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// runCommand for admin CLI commands, e.g. `go run . reconfig -server http://localhost:8080 -add 8083`
+func runCommand(args []string) int {
+	switch args[0] {
+	case "reconfig":
+		return reconfigCommand(args[1:])
+	case "transfer-leadership":
+		return transferLeadershipCommand(args[1:])
+	case "verify":
+		return verifyCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q, supported commands: reconfig, transfer-leadership, verify\n", args[0])
+		return 2
+	}
+}
+
+// reconfigCommand calls /admin/reconfig of any ZooWeeper server in the ensemble
+func reconfigCommand(args []string) int {
+	fs := flag.NewFlagSet("reconfig", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of any ZooWeeper server in the ensemble")
+	add := fs.String("add", "", "comma-separated ports of voting members to add")
+	observers := fs.String("observers", "", "comma-separated ports of observers to add")
+	remove := fs.String("remove", "", "comma-separated ports of members to remove")
+	fs.Parse(args)
+
+	reconfig := data.Reconfig{
+		AddParticipants: *add,
+		AddObservers:    *observers,
+		Remove:          *remove,
+	}
+	jsonData, _ := json.Marshal(reconfig)
+	return postAdmin(*server+"/admin/reconfig", jsonData)
+}
+
+// transferLeadershipCommand calls /admin/transferLeadership of any ZooWeeper server in the ensemble
+func transferLeadershipCommand(args []string) int {
+	fs := flag.NewFlagSet("transfer-leadership", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of any ZooWeeper server in the ensemble")
+	target := fs.String("target", "", "port of the Follower to become Leader, the most up-to-date one if empty")
+	fs.Parse(args)
+
+	jsonData, _ := json.Marshal(data.TransferLeadership{Target: *target})
+	return postAdmin(*server+"/admin/transferLeadership", jsonData)
+}
+
+// verifyCommand checks offline the checksums and digest of the ZTree of a stopped ZooWeeper server, exit code 1 if
+// it is corrupt, e.g. `go run . verify -db ztree/zooweeper-metadata-0.db`
+func verifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	db := fs.String("db", "", "SQLite database, or .txnlog directory of the txnlog storage engine")
+	fs.Parse(args)
+	if *db == "" {
+		fmt.Fprintln(os.Stderr, "Missing -db")
+		return 2
+	}
+
+	report, err := ztree.VerifyFile(*db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error verifying", *db+":", err)
+		return 1
+	}
+	fmt.Println(*db+":", report.String())
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// postAdmin request and print the response, exit code 1 unless it succeeded
+func postAdmin(url string, jsonData []byte) int {
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error calling", url+":", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	fmt.Println(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"github.com/tnbl265/zooweeper/zab"
+	"os"
+)
+
+// LoadConfig of the ensemble from a JSON file, e.g. `CONFIG_FILE=ensemble.json SERVER_ID=1 go run .`
+func LoadConfig(path string) (*data.EnsembleConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config data.EnsembleConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if config.DataDir == "" {
+		config.DataDir = "ztree"
+	}
+	return &config, validateConfig(&config)
+}
+
+// validateConfig rejects duplicate server ID or address, invalid ports or roles and an ensemble without participant
+func validateConfig(config *data.EnsembleConfig) error {
+	ids := make(map[int]bool)
+	addresses := make(map[string]bool)
+	participants := 0
+	for i := range config.Members {
+		member := &config.Members[i]
+		if member.Id <= 0 {
+			return fmt.Errorf("member %d must have a positive id", i)
+		}
+		if ids[member.Id] {
+			return fmt.Errorf("duplicate server id %d", member.Id)
+		}
+		ids[member.Id] = true
+
+		if member.Host == "" {
+			return fmt.Errorf("server %d has no host", member.Id)
+		}
+		if member.ClientPort <= 0 || member.PeerPort <= 0 {
+			return fmt.Errorf("server %d needs a clientPort and a peerPort", member.Id)
+		}
+		ports := []int{member.ClientPort}
+		if member.PeerPort != member.ClientPort {
+			ports = append(ports, member.PeerPort)
+		}
+		for _, port := range ports {
+			address := fmt.Sprintf("%s:%d", member.Host, port)
+			if addresses[address] {
+				return fmt.Errorf("address %s used twice", address)
+			}
+			addresses[address] = true
+		}
+
+		switch member.Role {
+		case "":
+			member.Role = zab.PARTICIPANT
+			participants++
+		case zab.PARTICIPANT:
+			participants++
+		case zab.OBSERVER:
+		default:
+			return fmt.Errorf("server %d has unknown role %q", member.Id, member.Role)
+		}
+	}
+	switch config.StorageEngine {
+	case "", "sqlite", "txnlog", "memory":
+	default:
+		return fmt.Errorf("unknown storageEngine %q", config.StorageEngine)
+	}
+	if participants == 0 {
+		return errors.New("config needs at least one participant")
+	}
+	return nil
+}
+
+// FindMember by server ID
+func FindMember(config *data.EnsembleConfig, id int) (data.Member, bool) {
+	for _, member := range config.Members {
+		if member.Id == id {
+			return member, true
+		}
+	}
+	return data.Member{}, false
+}
@@ -11,8 +11,8 @@ type Server struct {
 	Rp request_processors.RequestProcessor
 }
 
-func NewServer(dbPath string) *Server {
+func NewServer(dbPath, storageEngine string) *Server {
 	return &Server{
-		Rp: *request_processors.NewRequestProcessor(dbPath),
+		Rp: *request_processors.NewRequestProcessor(dbPath, storageEngine),
 	}
 }
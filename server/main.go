@@ -1,19 +1,102 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/tnbl265/zooweeper/ensemble"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"github.com/tnbl265/zooweeper/zab"
 	"github.com/tnbl265/zooweeper/ztree"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	var node nodeConfig
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		node = configNode(configFile)
+	} else {
+		node = portsNode()
+	}
+
+	// Start Server
+	server := ensemble.NewServer(node.dbPath, node.storageEngine)
+	if node.config != nil {
+		server.Rp.Zab.ApplyConfig(node.config)
+	}
+	if err := server.Rp.Zab.ValidateLeaderLease(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting Server %d on client port %d and peer port %d\n", node.id, node.clientPort, node.peerPort)
+
+	initLocalState(server, node.id, node.leader, node.allServers)
+
+	// Regular Health Checks and start Leader Election once failure detected
+	go server.Rp.Zab.WakeupLeaderElection(node.id)
+	go server.Rp.Zab.ListenForLeaderElection(node.id)
+	go server.Rp.Zab.StartHealthCheck()
+	go server.Rp.Zab.WatchQuorum(node.id)
+	go server.Rp.Zab.StartCompactor()
+
+	idStr := strconv.Itoa(node.id)
+	var httpServers []*http.Server
+	if node.clientPort == node.peerPort {
+		httpServers = append(httpServers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", node.clientPort),
+			Handler: server.Rp.Routes(idStr),
+		})
+	} else {
+		httpServers = append(httpServers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", node.clientPort),
+			Handler: server.Rp.ClientRoutes(idStr),
+		}, &http.Server{
+			Addr:    fmt.Sprintf(":%d", node.peerPort),
+			Handler: server.Rp.PeerRoutes(idStr),
+		})
+	}
+	for _, httpServer := range httpServers {
+		go func(httpServer *http.Server) {
+			err := httpServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(httpServer)
+	}
+
+	// Graceful shutdown on SIGTERM or SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	<-stop
+	shutdown(server, httpServers)
+}
+
+// nodeConfig of this ZooWeeper server, its server ID is also its port unless a CONFIG_FILE is given
+type nodeConfig struct {
+	id         int
+	clientPort int
+	peerPort   int
+	leader     int
+	allServers []int
+	dbPath     string
+	// storageEngine from the CONFIG_FILE, otherwise STORAGE_ENGINE
+	storageEngine string
+	config        *data.EnsembleConfig
+}
+
+// portsNode for servers on consecutive ports of one host, from START_PORT to END_PORT
+func portsNode() nodeConfig {
 	portStr := os.Getenv("PORT")
 	if portStr == "" {
 		portStr = "8080"
@@ -33,50 +116,107 @@ func main() {
 	}
 	endPort, _ := strconv.Atoi(endPortStr)
 
-	leader := endPort
 	allServers := make([]int, 0, endPort-startPort+1)
 	for p := startPort; p <= endPort; p++ {
 		allServers = append(allServers, p)
 	}
 
-	var dbPath string
-	if port >= startPort && port <= endPort {
-		dbPath = fmt.Sprintf("ztree/zooweeper-metadata-%d.db", port-startPort)
-	} else {
+	if port < startPort || port > endPort {
 		log.Fatalf("Only support ports %d to %d", startPort, endPort)
 	}
 
-	// Start Server
-	server := ensemble.NewServer(dbPath)
-	log.Printf("Starting Server on port %s\n", portStr)
-	defer func(connection *sql.DB) {
-		err := connection.Close()
-		if err != nil {
-			log.Fatal(err)
+	// Initially the highest port leads as Bully would elect, Observers never lead
+	observers := make(map[string]bool)
+	for _, observer := range strings.Split(os.Getenv("OBSERVERS"), ",") {
+		observers[strings.TrimSpace(observer)] = true
+	}
+	leader := 0
+	for _, p := range allServers {
+		if !observers[strconv.Itoa(p)] {
+			leader = p
 		}
-	}(server.Rp.Zab.ZTree.Connection())
+	}
+	if leader == 0 {
+		log.Fatal("OBSERVERS needs at least one participant from START_PORT to END_PORT")
+	}
+	return nodeConfig{
+		id:         port,
+		clientPort: port,
+		peerPort:   port,
+		leader:     leader,
+		allServers: allServers,
+		dbPath:     fmt.Sprintf("ztree/zooweeper-metadata-%d.db", port-startPort),
+	}
+}
 
-	// Regular Health Checks and start Leader Election once failure detected
-	var err error
-	go server.Rp.Zab.WakeupLeaderElection(port)
-	go server.Rp.Zab.ListenForLeaderElection(port, leader)
-	go server.Rp.Zab.StartHealthCheck()
+// configNode for the server SERVER_ID of the ensemble described in a CONFIG_FILE
+func configNode(configFile string) nodeConfig {
+	config, err := ensemble.LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := strconv.Atoi(os.Getenv("SERVER_ID"))
+	if err != nil {
+		log.Fatal("SERVER_ID must be set to the id of this server in ", configFile)
+	}
+	member, ok := ensemble.FindMember(config, id)
+	if !ok {
+		log.Fatalf("Server %d is not a member in %s", id, configFile)
+	}
 
-	initZNode(server, port, leader, allServers)
+	// Initially the participant with the highest id leads, as Bully would elect
+	leader := 0
+	var allServers []int
+	for _, m := range config.Members {
+		allServers = append(allServers, m.Id)
+		if m.Role != zab.OBSERVER && m.Id > leader {
+			leader = m.Id
+		}
+	}
+	sort.Ints(allServers)
 
-	err = http.ListenAndServe(fmt.Sprintf(":"+portStr), server.Rp.Routes(portStr))
+	err = os.MkdirAll(config.DataDir, 0755)
 	if err != nil {
 		log.Fatal(err)
 	}
-
+	return nodeConfig{
+		id:            id,
+		clientPort:    member.ClientPort,
+		peerPort:      member.PeerPort,
+		leader:        leader,
+		allServers:    allServers,
+		dbPath:        filepath.Join(config.DataDir, fmt.Sprintf("zooweeper-metadata-%d.db", id)),
+		storageEngine: config.StorageEngine,
+		config:        config,
+	}
 }
 
-// initZNode insert first ZNode to self-identify in the current ZooWeeper ensemble
-func initZNode(server *ensemble.Server, port, leader int, allServers []int) {
-	existFirstNode, _ := server.Rp.Zab.ZTree.ZNodeIdExists(1)
-	if existFirstNode {
-		return
+// shutdown drains the server while still answering the ensemble, then stops HTTP and closes the ZTree database
+func shutdown(server *ensemble.Server, httpServers []*http.Server) {
+	log.Println("Shutting down")
+	err := server.Rp.Zab.Drain()
+	if err != nil {
+		log.Println("Drain failed:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), server.Rp.Zab.ProposalTimeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		err = httpServer.Shutdown(ctx)
+		if err != nil {
+			log.Println("HTTP shutdown failed:", err)
+		}
+	}
+
+	err = server.Rp.Zab.ZTree.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Println("Shut down")
+}
+
+// initLocalState to self-identify in the current ZooWeeper ensemble, a restart keeps the ensemble view it had
+func initLocalState(server *ensemble.Server, id, leader int, allServers []int) {
 	var result []string
 	for _, server := range allServers {
 		result = append(result, strconv.Itoa(server))
@@ -84,10 +224,21 @@ func initZNode(server *ensemble.Server, port, leader int, allServers []int) {
 
 	allServersStr := strings.Join(result, ",")
 
-	metadata := ztree.Metadata{
-		NodePort: strconv.Itoa(port),
-		Leader:   strconv.Itoa(leader),
-		Servers:  allServersStr,
+	state := ztree.LocalState{
+		NodePort:  strconv.Itoa(id),
+		Leader:    strconv.Itoa(leader),
+		Servers:   allServersStr,
+		Observers: strings.Join(server.Rp.Zab.Observers(), ","),
+	}
+	err := server.Rp.Zab.ZTree.InitLocalState(state)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Observers may have changed through Reconfig before the restart
+	local, err := server.Rp.Zab.ZTree.GetLocalState()
+	if err != nil {
+		log.Fatal(err)
 	}
-	server.Rp.Zab.ZTree.InsertFirstMetadata(metadata)
+	server.Rp.Zab.SetObservers(strings.Split(local.Observers, ","))
 }
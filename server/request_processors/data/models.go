@@ -17,9 +17,31 @@ type GameResults struct {
 }
 
 type Data struct {
-	Timestamp   string         `json:"Timestamp"`
-	Metadata    ztree.Metadata `json:"Metadata"`
-	GameResults GameResults    `json:"GameResults"`
+	RequestId   string            `json:"RequestId,omitempty"`
+	ProposalId  int               `json:"ProposalId,omitempty"` // set by the Leader, echoed by the Follower in its ACK
+	Timestamp   string            `json:"Timestamp"`
+	Metadata    ztree.Metadata    `json:"Metadata"`
+	GameResults GameResults       `json:"GameResults"`
+	Reconfig    *Reconfig         `json:"Reconfig,omitempty"`
+	Digest      *ztree.TreeDigest `json:"Digest,omitempty"` // of the Leader once committed, compared by the Follower
+}
+
+// Reconfig of the ensemble membership committed through Zab, each field is a comma-separated list of ports
+type Reconfig struct {
+	AddParticipants string `json:"AddParticipants,omitempty"`
+	AddObservers    string `json:"AddObservers,omitempty"`
+	Remove          string `json:"Remove,omitempty"`
+	// Servers and Observers once applied, resolved by the Leader before proposing so every server ends up with the
+	// same membership whatever its own view before
+	Servers   string `json:"Servers,omitempty"`
+	Observers string `json:"Observers,omitempty"`
+}
+
+// ZxidResult tells the client the last zxid (highest ZNodeId) it can expect any server to have applied, to be sent
+// back as X-Min-Zxid header of a later Read Request
+type ZxidResult struct {
+	Zxid      int    `json:"zxid"`
+	RequestId string `json:"requestId,omitempty"`
 }
 
 type HealthCheck struct {
@@ -42,4 +64,166 @@ type ElectLeaderResponse struct {
 }
 type DeclareLeaderRequest struct {
 	IncomingPort string `json:"port"`
+	Epoch        int    `json:"epoch,omitempty"`
+}
+
+type PreVoteResponse struct {
+	Leader string `json:"leader"`
+	Epoch  int    `json:"epoch"`
+}
+
+// Vote for Fast Leader Election, ordered by (Epoch, Zxid, ServerId)
+type Vote struct {
+	Epoch    int    `json:"epoch"`
+	Zxid     int    `json:"zxid"`
+	ServerId string `json:"serverId"`
+}
+
+type VoteRequest struct {
+	Round int  `json:"round"`
+	Vote  Vote `json:"vote"`
+}
+
+type VoteResponse struct {
+	Round       int  `json:"round"`
+	Vote        Vote `json:"vote"`
+	Credentials Vote `json:"credentials"`
+}
+
+// TransferLeadership to Target, or to the most up-to-date Follower if empty
+type TransferLeadership struct {
+	Target string `json:"target,omitempty"`
+}
+
+// Heartbeat from the Leader to its Followers every tick
+type Heartbeat struct {
+	LeaderPort   string `json:"leaderPort"`
+	Epoch        int    `json:"epoch"`
+	Zxid         int    `json:"zxid"`
+	Digest       uint64 `json:"digest"`       // of the ZTree of the Leader at Zxid
+	PurgedDigest uint64 `json:"purgedDigest"` // a Follower with another one missed some purges of the Leader
+	HasQuorum    bool   `json:"hasQuorum"`
+}
+
+type HeartbeatAck struct {
+	PortNumber string `json:"portNumber"`
+	Zxid       int    `json:"zxid"`
+	Diverged   bool   `json:"diverged"`
+}
+
+// FollowerStatus as seen by the Leader from the HeartbeatAck
+type FollowerStatus struct {
+	Port             string `json:"port"`
+	Observer         bool   `json:"observer"`
+	Alive            bool   `json:"alive"`
+	LastHeartbeatAck string `json:"lastHeartbeatAck,omitempty"`
+	Zxid             int    `json:"zxid"`
+	Lag              int    `json:"lag"`
+	Diverged         bool   `json:"diverged"`
+}
+
+// DigestStatus of the ZTree of a server, digests in hexadecimal
+type DigestStatus struct {
+	Zxid         int         `json:"zxid"`
+	Digest       string      `json:"digest"`
+	PurgedDigest string      `json:"purgedDigest"`
+	Diverged     bool        `json:"diverged"`
+	Divergence   *Divergence `json:"divergence,omitempty"`
+	Resyncs      int         `json:"resyncs"`
+	LastResync   string      `json:"lastResync,omitempty"`
+}
+
+// Divergence of the ZTree of a server from the one of the Leader, detected by their digests at the same zxid
+type Divergence struct {
+	Leader       string `json:"leader"`
+	Zxid         int    `json:"zxid"`
+	LeaderDigest string `json:"leaderDigest"`
+	LocalDigest  string `json:"localDigest"`
+	DetectedAt   string `json:"detectedAt"`
+}
+
+// PhiStatus of the PhiAccrualDetector for one server, intervals in milliseconds
+type PhiStatus struct {
+	Port          string  `json:"port"`
+	Phi           float64 `json:"phi"`
+	Suspected     bool    `json:"suspected"`
+	Samples       int     `json:"samples"`
+	MeanInterval  int64   `json:"meanInterval"`
+	StdDeviation  int64   `json:"stdDeviation"`
+	LastHeartbeat string  `json:"lastHeartbeat,omitempty"`
+}
+
+// PurgeHistory with the NodeId of the ZNode the Leader purged, for every server to purge exactly the same ones once it
+// applied up to Zxid
+type PurgeHistory struct {
+	NodeIds []int `json:"nodeIds"`
+	Zxid    int   `json:"zxid"`
+}
+
+type PurgeHistoryResult struct {
+	Purged int `json:"purged"`
+}
+
+// ZNodeHistory of the process ZNode of a client (Kafka broker), versions up to PurgedZxid may have been purged
+type ZNodeHistory struct {
+	SenderIp   string         `json:"senderIp"`
+	PurgedZxid int            `json:"purgedZxid"`
+	Versions   []ZNodeVersion `json:"versions"`
+}
+
+type ZNodeVersion struct {
+	Version   int    `json:"version"`
+	Zxid      int    `json:"zxid"`
+	Timestamp string `json:"timestamp"`
+	Writer    string `json:"writer"` // ZooWeeper server the client sent the Write Request to
+	Clients   string `json:"clients"`
+}
+
+// EnsembleConfig from the CONFIG_FILE, every member is identified by its server ID. Durations in seconds unless
+// noted otherwise, zero values keep the defaults or environment variables.
+type EnsembleConfig struct {
+	DataDir       string   `json:"dataDir,omitempty"`
+	StorageEngine string   `json:"storageEngine,omitempty"` // sqlite (default), txnlog or memory
+	Members       []Member `json:"members"`
+
+	TickTime          int     `json:"tickTime,omitempty"` // milliseconds
+	SyncLimit         int     `json:"syncLimit,omitempty"`
+	PhiThreshold      float64 `json:"phiThreshold,omitempty"`
+	ProposalTimeout   int     `json:"proposalTimeout,omitempty"`
+	QuorumLossTimeout int     `json:"quorumLossTimeout,omitempty"`
+	LeaderLease       int     `json:"leaderLease,omitempty"`
+	MaxClockDrift     int     `json:"maxClockDrift,omitempty"` // milliseconds
+	SyncTimeout       int     `json:"syncTimeout,omitempty"`
+	RetentionVersions int     `json:"retentionVersions,omitempty"`
+	RetentionHours    int     `json:"retentionHours,omitempty"`
+
+	ElectionStrategy string `json:"electionStrategy,omitempty"`
+	Quorum           string `json:"quorum,omitempty"`
+	QuorumWeights    string `json:"quorumWeights,omitempty"`
+	QuorumGroups     string `json:"quorumGroups,omitempty"`
+	PreVote          *bool  `json:"preVote,omitempty"`
+	ReadOnlyMode     *bool  `json:"readOnlyMode,omitempty"`
+}
+
+// Member of the ensemble, serving clients (Kafka broker) on ClientPort and the other members on PeerPort
+type Member struct {
+	Id         int    `json:"id"`
+	Host       string `json:"host"`
+	ClientPort int    `json:"clientPort"`
+	PeerPort   int    `json:"peerPort"`
+	Role       string `json:"role,omitempty"` // participant (default) or observer
+}
+
+// EnsembleView served by the read-only virtual ZNode /zookeeper/config
+type EnsembleView struct {
+	Epoch   int          `json:"epoch"`
+	Leader  string       `json:"leader"`
+	Members []MemberView `json:"members"`
+}
+
+type MemberView struct {
+	Id        string `json:"id"`
+	Role      string `json:"role"`
+	ClientURL string `json:"clientUrl"`
+	PeerURL   string `json:"peerUrl"`
 }
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -54,18 +55,39 @@ func (rp *RequestProcessor) QueueMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// ClientRequestMiddleware refuses Read and Write Request from clients (Kafka broker) once the server is draining
+func (rp *RequestProcessor) ClientRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rp.Zab.Draining() {
+			rp.Zab.WriteError(w, zab.ErrDraining)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // WriteOpsMiddleware to establish some form of Total Order for Transaction using PriorityQueue
 func (rp *RequestProcessor) WriteOpsMiddleware(http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		zNode, err := rp.Zab.ZTree.GetLocalMetadata()
+		local, err := rp.Zab.ZTree.GetLocalState()
 		if err != nil {
 			log.Println("WriteOpsMiddleware Error:", err)
 			return
 		}
 
-		if zNode.NodePort != zNode.Leader {
+		if rp.Zab.ReadOnly() {
+			// Without a quorum, no write could ever be committed
+			rp.Zab.WriteError(w, zab.ErrReadOnly)
+			return
+		}
+		if local.Leader == "" {
+			rp.Zab.WriteError(w, zab.ErrNoLeader)
+			return
+		}
+
+		if local.NodePort != local.Leader {
 			// Follower will forward Request to Leader
-			color.HiBlue("%s forwarding request to leader %s", zNode.NodePort, zNode.Leader)
+			color.HiBlue("%s forwarding request to leader %s", local.NodePort, local.Leader)
 			resp, err := rp.Zab.ForwardRequestToLeader(r)
 			if err != nil {
 				// Handle error
@@ -86,12 +108,44 @@ func (rp *RequestProcessor) WriteOpsMiddleware(http.Handler) http.Handler {
 		} else {
 			// Leader will Propose, wait for Acknowledge, before Commit
 			data := rp.Zab.CreateMetadataFromPayload(w, r)
-			for rp.Zab.ProposalState() != zab.COMMITTED {
+			if data.RequestId == "" {
+				data.RequestId = r.Header.Get("X-Request-Id")
+			}
+			for !rp.Zab.ProposalIdle() {
 				// Propose in sequence to ensure Linearization Write
 				time.Sleep(time.Second)
 			}
-			rp.Zab.StartProposal(data)
+			if rp.Zab.WriteCommittedResult(w, data.RequestId) {
+				// Retry of an already committed Write Request
+				color.HiBlue("Leader %s skipping duplicate request %s", local.NodePort, data.RequestId)
+				return
+			}
+			// Leadership may have moved while waiting for the previous proposal
+			if current, _ := rp.Zab.ZTree.GetLocalState(); current.Leader != local.NodePort {
+				rp.Zab.WriteError(w, zab.ErrLeaderChanged)
+				return
+			}
+			result, err := rp.Zab.StartProposal(data)
+			if err != nil {
+				// e.g. 503 PROPOSAL_TIMEOUT or LEADER_TRANSFER for the Kafka broker to retry
+				rp.Zab.WriteError(w, err)
+				return
+			}
+			rp.Zab.WriteCommittedResponse(w, result)
 			return
 		}
 	})
 }
+
+// EpochFencingMiddleware rejects intra-ensemble messages from an older epoch with 409 STALE_EPOCH, answering with the
+// current epoch so a former Leader learns it was replaced
+func (rp *RequestProcessor) EpochFencingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := rp.Zab.CheckEpoch(r); err != nil {
+			w.Header().Set("X-Epoch", strconv.Itoa(rp.Zab.Epoch()))
+			rp.Zab.WriteError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
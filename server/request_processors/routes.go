@@ -1,6 +1,7 @@
 // Package request_processors implements the Request Processor component for our ZooWeeper. We make use of HTTP Protocol
 //
-// 1. All Write Request are forwarded to the Leader while Read Request are done locally in each server
+// 1. All Write Request are forwarded to the Leader while Read Request are done locally in each server, unless the
+// client asks for a sync or linearizable read
 // 2. Write Request are captured as Transaction with Timestamp field (generated by Kafka broker) as id
 // 3. QueueMiddleware will order Transaction by Timestamp using a Priority Queue helps guarantee
 //   - FIFO Client order: all Transaction is ordered by Timestamp generated by client (Kafka broker)
@@ -12,8 +13,10 @@
 //
 // 5. We also define other internal requests for some Distributed System features:
 // - Proposal Request for Data Synchronization when all ZooWeeper servers are healthy
-// - Leader Election Request: Distributed Coordination
+// - EpochFencingMiddleware rejects Proposal, Data Sync and heartbeat messages from an older epoch
+// - Leader Election Request: Distributed Coordination, using Bully or Fast Leader Election
 // - Data Sync Request for Data Synchronization when a ZooWeeper server joined or restarted, ensuring Fault Tolerance
+// - Admin Request to operate on the ensemble, e.g. Reconfig members while the ensemble runs
 //
 // Reference: Active Messaging in https://zookeeper.apache.org/doc/current/zookeeperInternals.html#sc_activeMessaging
 
@@ -33,56 +36,109 @@ type RequestProcessor struct {
 	pq  PriorityQueue
 }
 
-func NewRequestProcessor(dbPath string) *RequestProcessor {
+func NewRequestProcessor(dbPath, storageEngine string) *RequestProcessor {
 	rp := &RequestProcessor{}
-	rp.Zab = zab.NewAtomicBroadcast(dbPath)
+	rp.Zab = zab.NewAtomicBroadcast(dbPath, storageEngine)
 	rp.pq = make(PriorityQueue, 0)
 	heap.Init(&rp.pq)
 
 	return rp
 }
 
+// Routes of a ZooWeeper server serving clients and the other members on the same port
 func (rp *RequestProcessor) Routes(portStr string) http.Handler {
+	mux := rp.newRouter(portStr)
+	rp.clientRoutes(mux)
+	rp.peerRoutes(mux, portStr)
+	return mux
+}
+
+// ClientRoutes for clients (Kafka broker) and operators, when the CONFIG_FILE gives a separate client port
+func (rp *RequestProcessor) ClientRoutes(portStr string) http.Handler {
+	mux := rp.newRouter(portStr)
+	rp.clientRoutes(mux)
+	return mux
+}
+
+// PeerRoutes for the other members of the ensemble, when the CONFIG_FILE gives a separate peer port
+func (rp *RequestProcessor) PeerRoutes(portStr string) http.Handler {
+	mux := rp.newRouter(portStr)
+	rp.peerRoutes(mux, portStr)
+	return mux
+}
+
+func (rp *RequestProcessor) newRouter(portStr string) *chi.Mux {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
 	mux.Use(rp.Zab.EnableCORS)
 	mux.Use(middleware.WithValue("portStr", portStr))
+	return mux
+}
 
+func (rp *RequestProcessor) clientRoutes(mux *chi.Mux) {
 	// Read Request
 	mux.Group(func(r chi.Router) {
+		r.Use(rp.ClientRequestMiddleware)
+
 		r.Get("/metadata", rp.Zab.Read.GetAllMetadata)
+		r.Get("/metadata/history", rp.Zab.Read.GetHistory)
+		r.Get("/sync", rp.Zab.Read.Sync)
+		r.Get("/zookeeper/config", rp.Zab.Read.GetConfig)
 	})
 
 	// Write Request
 	mux.Group(func(r chi.Router) {
+		r.Use(rp.ClientRequestMiddleware)
 		r.Use(rp.QueueMiddleware)
 		r.Use(rp.WriteOpsMiddleware)
 
 		r.Post("/metadata", rp.Zab.Write.UpdateMetadata)
 	})
 
+	// Admin Request
+	mux.Group(func(r chi.Router) {
+		r.Post("/admin/reconfig", rp.Zab.Admin.Reconfig)
+		r.Post("/admin/transferLeadership", rp.Zab.Admin.TransferLeadership)
+		r.Post("/admin/drain", rp.Zab.Admin.Drain)
+		r.Get("/admin/followers", rp.Zab.Admin.Followers)
+		r.Get("/admin/phi", rp.Zab.Admin.Phi)
+		r.Get("/admin/digest", rp.Zab.Admin.Digest)
+	})
+}
+
+func (rp *RequestProcessor) peerRoutes(mux *chi.Mux, portStr string) {
 	// Proposal Request
 	mux.Group(func(r chi.Router) {
+		r.Use(rp.EpochFencingMiddleware)
+
 		r.Post("/proposeWrite", rp.Zab.Proposal.ProposeWrite)
 		r.Post("/acknowledgeProposal", rp.Zab.Proposal.AcknowledgeProposal)
 		r.Post("/commitWrite", rp.Zab.Proposal.CommitWrite)
+		r.Post("/inform", rp.Zab.Proposal.Inform)
 		r.Post("/writeMetadata", rp.Zab.Write.WriteMetadata)
 	})
 
 	// Leader Election Request
 	mux.Group(func(r chi.Router) {
 		r.Post("/", rp.Zab.Election.Ping(portStr))
+		r.With(rp.EpochFencingMiddleware).Post("/heartbeat", rp.Zab.Election.Heartbeat(portStr))
 		r.Post("/electLeader", rp.Zab.Election.SelfElectLeaderRequest(portStr))
 		r.Post("/declareLeaderReceive", rp.Zab.Election.DeclareLeaderReceive())
+		r.Post("/vote", rp.Zab.Election.Vote)
+		r.Post("/preVote", rp.Zab.Election.PreVote)
 	})
 
 	// Data Sync Request
 	mux.Group(func(r chi.Router) {
+		r.Use(rp.EpochFencingMiddleware)
+
 		r.Post("/syncRequest", rp.Zab.Sync.SyncRequestHandler)
 		r.Post("/syncResponse", rp.Zab.Sync.SyncResponseHandler)
 		r.Post("/requestMetadata", rp.Zab.Sync.RequestMetadataHandler)
 		r.Post("/updateMetadata", rp.Zab.Sync.UpdateMetadataHandler)
+		r.Post("/lastZxid", rp.Zab.Sync.LastZxidHandler)
+		r.Post("/purgeHistory", rp.Zab.Sync.PurgeHistoryHandler)
+		r.Post("/restoreSnapshot", rp.Zab.Sync.RestoreSnapshotHandler)
+		r.Post("/requestSnapshot", rp.Zab.Sync.RequestSnapshotHandler)
 	})
-
-	return mux
 }
@@ -0,0 +1,261 @@
+package zab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminOps for operations on the ensemble itself instead of the Kafka broker metadata
+type AdminOps struct {
+	ab *AtomicBroadcast
+}
+
+// Reconfig handler to add or remove members while the ensemble runs, committed as a Transaction through Zab
+func (ao *AdminOps) Reconfig(w http.ResponseWriter, r *http.Request) {
+	var reconfig data.Reconfig
+	err := ao.ab.readJSON(w, r, &reconfig)
+	if err != nil {
+		_ = ao.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+
+	local, _ := ao.ab.ZTree.GetLocalState()
+	err = validateReconfig(strings.Split(local.Servers, ","), local.Leader, ao.ab.configuredIds(), reconfig)
+	if err != nil {
+		_ = ao.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+
+	// Go through the Write Request path, so Followers forward the Reconfig to the Leader
+	payload := data.Data{
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Reconfig:  &reconfig,
+	}
+	jsonData, _ := json.Marshal(payload)
+
+	color.Magenta("%s submitting Reconfig %+v", local.NodePort, reconfig)
+	url := ao.ab.clientURL(local.NodePort) + "/metadata"
+	resp, err := ao.ab.sendRequest(url, "POST", jsonData)
+	if err != nil {
+		_ = ao.ab.writeJSON(w, http.StatusInternalServerError, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = ao.ab.writeJSON(w, resp.StatusCode, JSONResponse{Error: true, Message: "Reconfig failed"})
+		return
+	}
+	_ = ao.ab.writeJSON(w, http.StatusOK, JSONResponse{Message: "Reconfig committed", Data: reconfig})
+}
+
+// TransferLeadership handler to hand off leadership before restarting the Leader, Followers forward it to the Leader
+func (ao *AdminOps) TransferLeadership(w http.ResponseWriter, r *http.Request) {
+	local, _ := ao.ab.ZTree.GetLocalState()
+	if local.NodePort != local.Leader {
+		if local.Leader == "" {
+			ao.ab.WriteError(w, ErrNoLeader)
+			return
+		}
+		resp, err := ao.ab.ForwardRequestToLeader(r)
+		if err != nil {
+			ao.ab.WriteError(w, ErrNoLeader)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	var request data.TransferLeadership
+	if r.ContentLength != 0 {
+		err := ao.ab.readJSON(w, r, &request)
+		if err != nil {
+			_ = ao.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+			return
+		}
+	}
+
+	target, err := ao.ab.TransferLeadership(request.Target)
+	var zabErr *ZabError
+	if errors.As(err, &zabErr) {
+		ao.ab.WriteError(w, err)
+		return
+	}
+	if err != nil {
+		_ = ao.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+	_ = ao.ab.writeJSON(w, http.StatusOK, JSONResponse{Message: "Leadership transferred", Data: data.TransferLeadership{Target: target}})
+}
+
+// Drain handler to take this server out of service without exiting, e.g. before a restart
+func (ao *AdminOps) Drain(w http.ResponseWriter, r *http.Request) {
+	err := ao.ab.Drain()
+	if err != nil {
+		ao.ab.WriteError(w, err)
+		return
+	}
+	local, _ := ao.ab.ZTree.GetLocalState()
+	_ = ao.ab.writeJSON(w, http.StatusOK, JSONResponse{Message: local.NodePort + " drained"})
+}
+
+// Followers handler for the Leader to report liveness and lag of each Follower and Observer
+func (ao *AdminOps) Followers(w http.ResponseWriter, r *http.Request) {
+	local, _ := ao.ab.ZTree.GetLocalState()
+	if local.NodePort != local.Leader {
+		_ = ao.ab.writeJSON(w, http.StatusConflict, JSONResponse{Error: true, Message: local.NodePort + " is not the Leader"})
+		return
+	}
+	_ = ao.ab.writeJSON(w, http.StatusOK, ao.ab.FollowerStatus())
+}
+
+// Phi handler to report the suspicion level of the servers this one receives heartbeats from
+func (ao *AdminOps) Phi(w http.ResponseWriter, r *http.Request) {
+	payload := JSONResponse{
+		Message: fmt.Sprintf("Phi threshold %.2f", ao.ab.PhiThreshold),
+		Data:    ao.ab.PhiStatus(),
+	}
+	_ = ao.ab.writeJSON(w, http.StatusOK, payload)
+}
+
+// Digest handler to report the digest of the ZTree of this server and its divergence from the Leader if any
+func (ao *AdminOps) Digest(w http.ResponseWriter, r *http.Request) {
+	status, err := ao.ab.DigestStatus()
+	if err != nil {
+		ao.ab.WriteError(w, err)
+		return
+	}
+	_ = ao.ab.writeJSON(w, http.StatusOK, status)
+}
+
+// applyReconfig once committed, replacing the Servers and Observers in the LocalState by the resolved membership
+func (ab *AtomicBroadcast) applyReconfig(reconfig data.Reconfig) {
+	local, _ := ab.ZTree.GetLocalState()
+	if reconfig.Servers == "" {
+		reconfig = ab.resolveReconfig(reconfig)
+	}
+
+	ab.ZTree.UpdateEnsemble(reconfig.Servers, reconfig.Observers)
+	ab.SetObservers(splitPorts(reconfig.Observers))
+
+	color.Magenta("%s applied Reconfig, Servers %s, Observers %s", local.NodePort, reconfig.Servers, reconfig.Observers)
+	for _, port := range splitPorts(reconfig.Servers) {
+		if port == local.NodePort {
+			return
+		}
+	}
+	color.Red("%s is no longer a member of the ensemble", local.NodePort)
+}
+
+// resolveReconfig into the resulting Servers and Observers from the membership of the Leader
+func (ab *AtomicBroadcast) resolveReconfig(reconfig data.Reconfig) data.Reconfig {
+	local, _ := ab.ZTree.GetLocalState()
+
+	removed := make(map[string]bool)
+	for _, port := range splitPorts(reconfig.Remove) {
+		removed[port] = true
+	}
+
+	members := make(map[string]bool)
+	for _, port := range splitPorts(local.Servers) {
+		if !removed[port] {
+			members[port] = true
+		}
+	}
+	observers := make(map[string]bool)
+	for _, port := range ab.Observers() {
+		if !removed[port] {
+			observers[port] = true
+		}
+	}
+	for _, port := range splitPorts(reconfig.AddParticipants) {
+		members[port] = true
+		delete(observers, port)
+	}
+	for _, port := range splitPorts(reconfig.AddObservers) {
+		members[port] = true
+		observers[port] = true
+	}
+
+	reconfig.Servers = strings.Join(sortedPorts(members), ",")
+	reconfig.Observers = strings.Join(sortedPorts(observers), ",")
+	return reconfig
+}
+
+// validateReconfig rejects malformed ports, adding a server missing from the CONFIG_FILE if configured is not nil,
+// removing the Leader and removing all voting members
+func validateReconfig(servers []string, leader string, configured map[string]bool, reconfig data.Reconfig) error {
+	current := make(map[string]bool)
+	for _, port := range servers {
+		current[port] = true
+	}
+
+	all := append(splitPorts(reconfig.AddParticipants), splitPorts(reconfig.AddObservers)...)
+	all = append(all, splitPorts(reconfig.Remove)...)
+	if len(all) == 0 {
+		return errors.New("reconfig must add or remove at least one server")
+	}
+	for _, port := range all {
+		if _, err := strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	for _, port := range append(splitPorts(reconfig.AddParticipants), splitPorts(reconfig.AddObservers)...) {
+		if configured != nil && !configured[port] {
+			return fmt.Errorf("%s is not a member of the CONFIG_FILE", port)
+		}
+	}
+
+	remaining := len(servers)
+	for _, port := range splitPorts(reconfig.Remove) {
+		if port == leader {
+			return fmt.Errorf("can not remove Leader %s", leader)
+		}
+		if !current[port] {
+			return fmt.Errorf("%s is not a member", port)
+		}
+		remaining--
+	}
+	if remaining+len(splitPorts(reconfig.AddParticipants)) == 0 {
+		return errors.New("reconfig must keep at least one voting member")
+	}
+	return nil
+}
+
+// splitPorts of a comma-separated list, ignoring empty entries
+func splitPorts(ports string) []string {
+	var result []string
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if port != "" {
+			result = append(result, port)
+		}
+	}
+	return result
+}
+
+// sortedPorts in numeric order, as Bully relies on the highest port
+func sortedPorts(ports map[string]bool) []string {
+	var result []string
+	for port := range ports {
+		result = append(result, port)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, _ := strconv.Atoi(result[i])
+		b, _ := strconv.Atoi(result[j])
+		return a < b
+	})
+	return result
+}
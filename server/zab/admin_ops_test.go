@@ -0,0 +1,35 @@
+package zab
+
+import (
+	"testing"
+
+	"github.com/tnbl265/zooweeper/request_processors/data"
+)
+
+func TestValidateReconfig(t *testing.T) {
+	servers := []string{"1", "2", "3"}
+	configured := map[string]bool{"1": true, "2": true, "3": true, "4": true}
+	tests := []struct {
+		name       string
+		configured map[string]bool
+		reconfig   data.Reconfig
+		valid      bool
+	}{
+		{"add a configured server", configured, data.Reconfig{AddParticipants: "4"}, true},
+		{"add a server missing from the config", configured, data.Reconfig{AddParticipants: "5"}, false},
+		{"add an observer missing from the config", configured, data.Reconfig{AddObservers: "5"}, false},
+		{"add any port without config", nil, data.Reconfig{AddParticipants: "8083"}, true},
+		{"invalid port", nil, data.Reconfig{AddParticipants: "a"}, false},
+		{"remove the Leader", configured, data.Reconfig{Remove: "3"}, false},
+		{"remove a non-member", configured, data.Reconfig{Remove: "4"}, false},
+		{"nothing to change", configured, data.Reconfig{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateReconfig(servers, "3", test.configured, test.reconfig)
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
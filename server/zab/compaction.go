@@ -0,0 +1,247 @@
+package zab
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"github.com/tnbl265/zooweeper/ztree"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StartCompactor purges superseded versions of every process ZNode every CompactionInterval, keeping the last
+// RetentionVersions versions or those of the last RetentionHours. Only the Leader applies the retention, it sends the
+// NodeId it purged to every other server so the ensemble purges the same ZNode.
+func (ab *AtomicBroadcast) StartCompactor() {
+	if ab.RetentionVersions <= 0 && ab.RetentionHours <= 0 {
+		return
+	}
+	for {
+		time.Sleep(ab.CompactionInterval)
+		if ab.Draining() {
+			continue
+		}
+		local, _ := ab.ZTree.GetLocalState()
+		if local.NodePort != local.Leader {
+			continue
+		}
+
+		var before time.Time
+		if ab.RetentionHours > 0 {
+			before = time.Now().Add(-time.Duration(ab.RetentionHours) * time.Hour)
+		}
+		purged, err := ab.ZTree.PurgeHistory(ab.RetentionVersions, before)
+		if err != nil {
+			color.Red("%s failed to purge history: %s", local.NodePort, err)
+			continue
+		}
+		if len(purged) == 0 {
+			continue
+		}
+		ab.logPurged(local.NodePort, len(purged))
+
+		// A server missing it catches up once a heartbeat shows another PurgedDigest
+		zxid, _ := ab.ZTree.GetHighestZNodeId()
+		jsonData, _ := json.Marshal(data.PurgeHistory{NodeIds: purged, Zxid: zxid})
+		for _, port := range strings.Split(local.Servers, ",") {
+			if port == local.NodePort {
+				continue
+			}
+			go func(port string) {
+				resp, err := ab.sendRequest(ab.peerURL(port)+"/purgeHistory", "POST", jsonData)
+				if err != nil {
+					color.Red("%s failed to send purged history to %s: %s", local.NodePort, port, err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					color.Red("%s failed to purge history with status %d", port, resp.StatusCode)
+				}
+			}(port)
+		}
+	}
+}
+
+// logPurged with the resulting PurgedZxid
+func (ab *AtomicBroadcast) logPurged(nodePort string, purged int) {
+	purgedZxid, _ := ab.ZTree.GetPurgedZxid()
+	color.Cyan("%s purged %d superseded ZNode, PurgedZxid %d", nodePort, purged, purgedZxid)
+}
+
+// sendMissingMetadata to a server behind the Leader: the Metadata after its zxid, or a whole Snapshot if some of them
+// were already purged (Ref: DIFF and SNAP in https://zookeeper.apache.org/doc/current/zookeeperInternals.html)
+func (ab *AtomicBroadcast) sendMissingMetadata(port string, zxid int) error {
+	purgedZxid, _ := ab.ZTree.GetPurgedZxid()
+	if zxid >= purgedZxid {
+		metadatas, _ := ab.ZTree.GetMetadatasGreaterThanZNodeId(zxid)
+		treeDigest, err := ab.ZTree.GetDigest()
+		if err == nil {
+			metadatas.Digest = &treeDigest
+		}
+		metadatas.RequestLog, _ = ab.ZTree.GetRequestLog()
+		if purgedZxid > 0 {
+			retained, _ := ab.ZTree.AllMetadataAsOf(purgedZxid)
+			metadatas.PurgedZxid = purgedZxid
+			for _, metadata := range retained {
+				metadatas.Retained = append(metadatas.Retained, metadata.NodeId)
+			}
+		}
+		jsonData, _ := json.Marshal(metadatas)
+		_, err = ab.sendRequest(ab.peerURL(port)+"/updateMetadata", "POST", jsonData)
+		return err
+	}
+
+	color.Yellow("%s is behind PurgedZxid %d, sending a snapshot", port, purgedZxid)
+	return ab.sendSnapshot(port)
+}
+
+// comparePurged digest of this server with the one of the Leader, on another one this server missed a /purgeHistory
+// and asks the Leader for its missing Metadata, which lists the ZNode it retained
+func (ab *AtomicBroadcast) comparePurged(leader string, leaderPurgedDigest uint64) {
+	treeDigest, err := ab.ZTree.GetDigest()
+	if err != nil || treeDigest.PurgedDigest == leaderPurgedDigest {
+		return
+	}
+	ab.digestMu.Lock()
+	syncing := ab.purgeSyncing
+	ab.purgeSyncing = true
+	ab.digestMu.Unlock()
+	if syncing {
+		return
+	}
+
+	go func() {
+		defer func() {
+			ab.digestMu.Lock()
+			ab.purgeSyncing = false
+			ab.digestMu.Unlock()
+		}()
+		jsonData, _ := json.Marshal(ztree.Metadata{NodeId: treeDigest.Zxid})
+		resp, err := ab.sendRequest(ab.peerURL(leader)+"/requestMetadata", "POST", jsonData)
+		if err != nil {
+			color.Red("Failed to request the history purged by Leader %s: %s", leader, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// catchUpPurged the versions the Leader purged up to purgedZxid while this server missed them: every ZNode up to it
+// the Leader no longer retains, unless both already have the same PurgedDigest
+func (ab *AtomicBroadcast) catchUpPurged(leaderPurgedDigest uint64, purgedZxid int, retained []int) {
+	treeDigest, err := ab.ZTree.GetDigest()
+	if err != nil || treeDigest.PurgedDigest == leaderPurgedDigest || purgedZxid == 0 {
+		return
+	}
+	kept := make(map[int]bool)
+	for _, nodeId := range retained {
+		kept[nodeId] = true
+	}
+	metadatas, err := ab.ZTree.AllMetadataAsOf(purgedZxid)
+	if err != nil {
+		return
+	}
+	var missed []int
+	for _, metadata := range metadatas {
+		if !kept[metadata.NodeId] {
+			missed = append(missed, metadata.NodeId)
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+
+	local, _ := ab.ZTree.GetLocalState()
+	if err := ab.ZTree.PurgeZNodes(missed); err != nil {
+		color.Red("%s failed to purge the history missed: %s", local.NodePort, err)
+		return
+	}
+	ab.logPurged(local.NodePort, len(missed))
+}
+
+// sendSnapshot of the whole ZTree to replace the one of another server
+func (ab *AtomicBroadcast) sendSnapshot(port string) error {
+	snapshot, err := ab.ZTree.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.RequestLog, _ = ab.ZTree.GetRequestLog()
+	jsonData, _ := json.Marshal(snapshot)
+	resp, err := ab.sendRequest(ab.peerURL(port)+"/restoreSnapshot", "POST", jsonData)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed to restore the snapshot with status %d", port, resp.StatusCode)
+	}
+	return nil
+}
+
+// mergeRequestLog of the Leader into the local one, so this server still recognizes a retried Write Request once Leader
+func (ab *AtomicBroadcast) mergeRequestLog(entries []ztree.RequestEntry) {
+	for _, entry := range entries {
+		if _, ok, _ := ab.ZTree.GetRequestResult(entry.RequestId); ok {
+			continue
+		}
+		err := ab.ZTree.InsertRequestResult(entry.RequestId, entry.Result)
+		if err != nil {
+			color.Red("Error merging RequestLog: %s", err)
+			return
+		}
+	}
+}
+
+// PurgeHistoryHandler handler for a server to purge the same ZNode as the Leader
+func (so *SyncOps) PurgeHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	local, _ := so.ab.ZTree.GetLocalState()
+
+	var purge data.PurgeHistory
+	err := so.ab.readJSON(w, r, &purge)
+	if err != nil {
+		_ = so.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+
+	// A later version superseded the purged ones, purging them before it is applied would shift its Version
+	if !so.ab.waitForZxid(purge.Zxid, so.ab.SyncTimeout) {
+		so.ab.WriteError(w, ErrSyncTimeout)
+		return
+	}
+
+	err = so.ab.ZTree.PurgeZNodes(purge.NodeIds)
+	if err != nil {
+		color.Red("%s failed to purge history: %s", local.NodePort, err)
+		so.ab.WriteError(w, err)
+		return
+	}
+	so.ab.logPurged(local.NodePort, len(purge.NodeIds))
+	_ = so.ab.writeJSON(w, http.StatusOK, data.PurgeHistoryResult{Purged: len(purge.NodeIds)})
+}
+
+// RestoreSnapshotHandler handler for a server too far behind to replace its ZTree by a Snapshot of the Leader
+func (so *SyncOps) RestoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	local, _ := so.ab.ZTree.GetLocalState()
+	clientPort := r.Header.Get("X-Sender-Port")
+
+	var snapshot ztree.Snapshot
+	err := so.ab.readJSONLimit(w, r, &snapshot, so.ab.SyncMaxBytes)
+	if err != nil {
+		// A truncated Snapshot must never replace the ZTree
+		color.Red("%s failed to read snapshot from %s: %s", local.NodePort, clientPort, err)
+		_ = so.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
+
+	err = so.ab.ZTree.RestoreSnapshot(snapshot)
+	if err != nil {
+		color.Red("%s failed to restore snapshot from %s: %s", local.NodePort, clientPort, err)
+		so.ab.WriteError(w, err)
+		return
+	}
+	so.ab.mergeRequestLog(snapshot.RequestLog)
+	color.Yellow("%s restored snapshot with %d ZNode from %s", local.NodePort, len(snapshot.MetadataList), clientPort)
+	_ = so.ab.writeJSON(w, http.StatusOK, "Restored Snapshot")
+}
@@ -0,0 +1,73 @@
+package zab
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tnbl265/zooweeper/ztree"
+)
+
+func memoryServer(t *testing.T, writes ...string) *AtomicBroadcast {
+	t.Helper()
+	mt := ztree.NewMemoryTree()
+	mt.InitializeDB()
+	for _, clients := range writes {
+		if _, err := mt.InsertMetadataWithParent(ztree.Metadata{Clients: clients, SenderIp: "9090"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := mt.InitLocalState(ztree.LocalState{NodePort: "8080", Leader: "8082", Servers: "8080,8081,8082"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AtomicBroadcast{ZTree: mt}
+}
+
+func TestCatchUpPurged(t *testing.T) {
+	writes := []string{"9090", "9090,1", "9090,2", "9090,3"}
+	leader := memoryServer(t, writes...)
+	follower := memoryServer(t, writes...)
+	purged, err := leader.ZTree.PurgeHistory(1, time.Time{})
+	if err != nil || len(purged) == 0 {
+		t.Fatalf("purged %v, %v", purged, err)
+	}
+
+	// The Metadatas the Leader sends while syncing the Follower which missed the /purgeHistory
+	treeDigest, _ := leader.ZTree.GetDigest()
+	purgedZxid, _ := leader.ZTree.GetPurgedZxid()
+	retained, _ := leader.ZTree.AllMetadataAsOf(purgedZxid)
+	var retainedIds []int
+	for _, metadata := range retained {
+		retainedIds = append(retainedIds, metadata.NodeId)
+	}
+	follower.catchUpPurged(treeDigest.PurgedDigest, purgedZxid, retainedIds)
+
+	got, _ := follower.ZTree.GetDigest()
+	if got != treeDigest {
+		t.Fatalf("follower digest %+v, leader digest %+v", got, treeDigest)
+	}
+	leaderZNodes, _ := leader.ZTree.AllMetadata()
+	followerZNodes, _ := follower.ZTree.AllMetadata()
+	if fmt.Sprint(nodeIds(followerZNodes)) != fmt.Sprint(nodeIds(leaderZNodes)) {
+		t.Fatalf("follower kept %v, leader kept %v", nodeIds(followerZNodes), nodeIds(leaderZNodes))
+	}
+}
+
+func TestCatchUpPurgedInSync(t *testing.T) {
+	follower := memoryServer(t, "9090", "9090,1")
+	treeDigest, _ := follower.ZTree.GetDigest()
+	// Same PurgedDigest as the Leader, nothing this server keeps is purged even if missing from the retained list
+	follower.catchUpPurged(treeDigest.PurgedDigest, 3, nil)
+	if zNodes, _ := follower.ZTree.AllMetadata(); len(zNodes) != 3 {
+		t.Fatalf("kept %d ZNode", len(zNodes))
+	}
+}
+
+func nodeIds(metadatas []*ztree.Metadata) []int {
+	var ids []int
+	for _, metadata := range metadatas {
+		ids = append(ids, metadata.NodeId)
+	}
+	return ids
+}
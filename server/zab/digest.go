@@ -0,0 +1,118 @@
+package zab
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"net/http"
+	"time"
+)
+
+// compareDigest of this server with the one of the Leader at the same zxid, a divergence is flagged and fixed by
+// restoring a snapshot of the Leader (Ref: digest in https://zookeeper.apache.org/doc/current/zookeeperAdmin.html)
+func (ab *AtomicBroadcast) compareDigest(leader string, zxid int, leaderDigest uint64) {
+	localDigest, ok, err := ab.ZTree.GetDigestAt(zxid)
+	if err != nil || !ok {
+		// Behind the Leader or already purged, compared again at a later zxid
+		return
+	}
+	if localDigest == leaderDigest {
+		return
+	}
+
+	local, _ := ab.ZTree.GetLocalState()
+	ab.digestMu.Lock()
+	if ab.divergence == nil {
+		color.Red("%s diverged from Leader %s at zxid %d: digest %016x instead of %016x", local.NodePort, leader, zxid, localDigest, leaderDigest)
+		ab.divergence = &data.Divergence{
+			Leader:       leader,
+			Zxid:         zxid,
+			LeaderDigest: fmt.Sprintf("%016x", leaderDigest),
+			LocalDigest:  fmt.Sprintf("%016x", localDigest),
+			DetectedAt:   time.Now().Format(time.RFC3339),
+		}
+	}
+	resyncing := ab.resyncing || time.Now().Before(ab.retryAt)
+	if !resyncing {
+		ab.resyncing = true
+	}
+	ab.digestMu.Unlock()
+
+	if !resyncing {
+		go ab.resync(local.NodePort, leader)
+	}
+}
+
+// resync the whole ZTree from a snapshot of the Leader, compared again at the next heartbeat
+func (ab *AtomicBroadcast) resync(nodePort, leader string) {
+	color.Yellow("%s requesting a snapshot from Leader %s", nodePort, leader)
+	resp, err := ab.sendRequest(ab.peerURL(leader)+"/requestSnapshot", "POST", nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+
+	ab.digestMu.Lock()
+	defer ab.digestMu.Unlock()
+	ab.resyncing = false
+	if err != nil {
+		color.Red("%s failed to resync from Leader %s: %s", nodePort, leader, err)
+		ab.retryAt = time.Now().Add(ab.syncLimitDuration())
+		return
+	}
+	color.Green("%s resynced from Leader %s", nodePort, leader)
+	ab.divergence = nil
+	ab.resyncs++
+	ab.lastResync = time.Now()
+}
+
+// Diverged if this server detected a divergence from the Leader not yet fixed
+func (ab *AtomicBroadcast) Diverged() bool {
+	ab.digestMu.Lock()
+	defer ab.digestMu.Unlock()
+	return ab.divergence != nil
+}
+
+// DigestStatus of the ZTree of this server and its divergence from the Leader if any
+func (ab *AtomicBroadcast) DigestStatus() (data.DigestStatus, error) {
+	treeDigest, err := ab.ZTree.GetDigest()
+	if err != nil {
+		return data.DigestStatus{}, err
+	}
+
+	ab.digestMu.Lock()
+	defer ab.digestMu.Unlock()
+	status := data.DigestStatus{
+		Zxid:         treeDigest.Zxid,
+		Digest:       fmt.Sprintf("%016x", treeDigest.Digest),
+		PurgedDigest: fmt.Sprintf("%016x", treeDigest.PurgedDigest),
+		Diverged:     ab.divergence != nil,
+		Divergence:   ab.divergence,
+		Resyncs:      ab.resyncs,
+	}
+	if !ab.lastResync.IsZero() {
+		status.LastResync = ab.lastResync.Format(time.RFC3339)
+	}
+	return status, nil
+}
+
+// RequestSnapshotHandler handler for the Leader to send a Snapshot to a server whose ZTree diverged
+func (so *SyncOps) RequestSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	local, _ := so.ab.ZTree.GetLocalState()
+	clientPort := r.Header.Get("X-Sender-Port")
+	if local.NodePort != local.Leader {
+		so.ab.WriteError(w, ErrNotLeader)
+		return
+	}
+
+	color.Yellow("%s received RequestSnapshot from diverged %s", local.NodePort, clientPort)
+	err := so.ab.sendSnapshot(clientPort)
+	if err != nil {
+		color.Red("%s failed to send snapshot to %s: %s", local.NodePort, clientPort, err)
+		so.ab.WriteError(w, err)
+		return
+	}
+	_ = so.ab.writeJSON(w, http.StatusOK, "Sent Snapshot")
+}
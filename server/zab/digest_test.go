@@ -0,0 +1,97 @@
+package zab
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tnbl265/zooweeper/request_processors/data"
+)
+
+// followerOf a Leader 8082 answering /requestSnapshot with status, counting the snapshots requested
+func followerOf(t *testing.T, status int) (*AtomicBroadcast, *int32) {
+	var requested int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/requestSnapshot" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		atomic.AddInt32(&requested, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(leader.Close)
+
+	leaderURL, _ := url.Parse(leader.URL)
+	peerPort, _ := strconv.Atoi(leaderURL.Port())
+	ab := memoryServer(t, "9090", "9090,1")
+	ab.members = map[string]data.Member{"8082": {Id: 8082, Host: leaderURL.Hostname(), PeerPort: peerPort}}
+	ab.TickTime, ab.SyncLimit = time.Second, 5
+	return ab, &requested
+}
+
+func waitResync(ab *AtomicBroadcast) {
+	for {
+		ab.digestMu.Lock()
+		resyncing := ab.resyncing
+		ab.digestMu.Unlock()
+		if !resyncing {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompareDigestSame(t *testing.T) {
+	ab, requested := followerOf(t, http.StatusOK)
+	treeDigest, _ := ab.ZTree.GetDigest()
+
+	ab.compareDigest("8082", treeDigest.Zxid, treeDigest.Digest)
+	// Behind the Leader, compared again later
+	ab.compareDigest("8082", treeDigest.Zxid+1, treeDigest.Digest+1)
+	waitResync(ab)
+	if ab.Diverged() || atomic.LoadInt32(requested) != 0 {
+		t.Fatalf("diverged %v after %d snapshot requested", ab.Diverged(), atomic.LoadInt32(requested))
+	}
+}
+
+func TestCompareDigestResync(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		diverged  bool
+		resyncs   int
+		requested int32 // once the divergence is detected again at the next heartbeat
+	}{
+		{"divergence cleared once resynced", http.StatusOK, false, 1, 2},
+		{"divergence kept when the resync fails", http.StatusInternalServerError, true, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ab, requested := followerOf(t, test.status)
+			treeDigest, _ := ab.ZTree.GetDigest()
+
+			ab.compareDigest("8082", treeDigest.Zxid, treeDigest.Digest+1)
+			if !ab.Diverged() {
+				t.Fatal("divergence not detected")
+			}
+			waitResync(ab)
+
+			status, _ := ab.DigestStatus()
+			if status.Diverged != test.diverged || status.Resyncs != test.resyncs {
+				t.Fatalf("diverged %v after %d resyncs", status.Diverged, status.Resyncs)
+			}
+			if test.diverged && status.Divergence.Zxid != treeDigest.Zxid {
+				t.Fatalf("divergence %+v", status.Divergence)
+			}
+			// A failed resync is only retried after SyncLimit ticks
+			ab.compareDigest("8082", treeDigest.Zxid, treeDigest.Digest+1)
+			waitResync(ab)
+			if atomic.LoadInt32(requested) != test.requested {
+				t.Fatalf("requested %d snapshots", atomic.LoadInt32(requested))
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package zab
+
+import (
+	"github.com/fatih/color"
+	"time"
+)
+
+// Draining once Drain was called, client requests are refused
+func (ab *AtomicBroadcast) Draining() bool {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	return ab.draining
+}
+
+// healthChecksStopped once drained, heartbeats of a draining Leader keep its Followers from electing another one
+// during the handoff
+func (ab *AtomicBroadcast) healthChecksStopped() bool {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	return ab.healthStopped
+}
+
+func (ab *AtomicBroadcast) stopHealthChecks() {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	ab.healthStopped = true
+}
+
+// Drain this server out of the ensemble's service before a shutdown: refuse client requests with ErrDraining, finish
+// in-flight proposals, hand off leadership if it is the Leader and only then stop health checks. The server keeps
+// answering the other servers, so a drained Follower still ACKs proposals until it exits.
+func (ab *AtomicBroadcast) Drain() error {
+	ab.healthMu.Lock()
+	ab.draining = true
+	ab.healthMu.Unlock()
+
+	local, _ := ab.ZTree.GetLocalState()
+	color.Magenta("%s draining", local.NodePort)
+
+	deadline := time.Now().Add(ab.ProposalTimeout)
+	for !ab.ProposalIdle() {
+		if time.Now().After(deadline) {
+			color.Red("%s could not finish in-flight proposal, aborting it", local.NodePort)
+			ab.abortProposal()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	local, _ = ab.ZTree.GetLocalState()
+	if local.NodePort == local.Leader {
+		if _, err := ab.TransferLeadership(""); err != nil {
+			color.Red("%s failed to hand off leadership: %s", local.NodePort, err)
+			return err
+		}
+	}
+
+	ab.stopHealthChecks()
+	color.Magenta("%s drained", local.NodePort)
+	return nil
+}
@@ -0,0 +1,45 @@
+package zab
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tnbl265/zooweeper/ztree"
+)
+
+func drainingServer(t *testing.T, leader string) *AtomicBroadcast {
+	mt := ztree.NewMemoryTree()
+	mt.InitializeDB()
+	err := mt.InitLocalState(ztree.LocalState{NodePort: "8080", Leader: leader, Servers: "8080,8081,8082"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AtomicBroadcast{
+		ZTree:           mt,
+		proposalState:   COMMITTED,
+		ProposalTimeout: time.Second,
+		TickTime:        time.Second,
+		SyncLimit:       5,
+	}
+}
+
+func TestDrainFollowerStopsHealthChecks(t *testing.T) {
+	ab := drainingServer(t, "8082")
+	if err := ab.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if !ab.Draining() || !ab.healthChecksStopped() {
+		t.Fatalf("draining %v, health checks stopped %v", ab.Draining(), ab.healthChecksStopped())
+	}
+}
+
+func TestDrainLeaderHeartbeatsUntilHandedOff(t *testing.T) {
+	// No Follower heard of, the handoff fails and the Leader keeps heartbeating
+	ab := drainingServer(t, "8080")
+	if err := ab.Drain(); err == nil {
+		t.Fatal("drained without a Follower to hand off leadership to")
+	}
+	if !ab.Draining() || ab.healthChecksStopped() {
+		t.Fatalf("draining %v, health checks stopped %v", ab.Draining(), ab.healthChecksStopped())
+	}
+}
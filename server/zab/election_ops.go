@@ -15,9 +15,26 @@ import (
 	"time"
 )
 
-// ElectionOps for Leader Election messages using Bully Algorithm
+// ElectionOps for Leader Election messages, the Leader is decided by the configured ElectionStrategy
 type ElectionOps struct {
 	ab *AtomicBroadcast
+
+	Strategy ElectionStrategy
+}
+
+// ElectionStrategy decides the Leader once a ZooWeeper server starts an election with a <self-elect> message
+type ElectionStrategy interface {
+	Name() string
+	SelfElectLeaderRequest(portStr string) http.HandlerFunc
+}
+
+// BullyElection always elects the highest port that is still alive
+type BullyElection struct {
+	ab *AtomicBroadcast
+}
+
+func (be *BullyElection) Name() string {
+	return "bully"
 }
 
 // Ping handler for ZooWeeper server to reply with Pong upon receive HealthCheck message
@@ -25,6 +42,7 @@ func (eo *ElectionOps) Ping(portStr string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var requestPayload data.HealthCheck
 		eo.ab.readJSON(w, r, &requestPayload)
+		eo.ab.recordContact(r.Header.Get("X-Sender-Port"))
 
 		payload := data.HealthCheck{
 			Message:    "pong",
@@ -35,14 +53,49 @@ func (eo *ElectionOps) Ping(portStr string) http.HandlerFunc {
 	}
 }
 
+// Heartbeat handler for a Follower to track its Leader and compare their digests, replying with its highest ZNodeId so
+// the Leader knows the lag
+func (eo *ElectionOps) Heartbeat(portStr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var heartbeat data.Heartbeat
+		err := eo.ab.readJSON(w, r, &heartbeat)
+		if err != nil {
+			_ = eo.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+			return
+		}
+
+		local, _ := eo.ab.ZTree.GetLocalState()
+		if heartbeat.LeaderPort == local.Leader {
+			eo.ab.setLeaderHeartbeat(heartbeat)
+			eo.ab.recordHeartbeat(heartbeat.LeaderPort)
+			eo.ab.compareDigest(heartbeat.LeaderPort, heartbeat.Zxid, heartbeat.Digest)
+			eo.ab.comparePurged(heartbeat.LeaderPort, heartbeat.PurgedDigest)
+		}
+
+		highestZNodeId, _ := eo.ab.ZTree.GetHighestZNodeId()
+		payload := data.HeartbeatAck{
+			PortNumber: portStr,
+			Zxid:       highestZNodeId,
+			Diverged:   eo.ab.Diverged(),
+		}
+		_ = eo.ab.writeJSON(w, http.StatusOK, payload)
+	}
+}
+
 // SelfElectLeaderRequest handler for ZooWeeper server to response to <self-elect> message
 func (eo *ElectionOps) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
+	color.Cyan("%s using %s Leader Election", portStr, eo.Strategy.Name())
+	return eo.Strategy.SelfElectLeaderRequest(portStr)
+}
+
+// SelfElectLeaderRequest handler for Bully, forwarding <self-elect> to all higher ports
+func (be *BullyElection) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
 	const REQUEST_TIMEOUT = 10 // Arbitrary wait timer to simulate response time arrival
 	return func(w http.ResponseWriter, r *http.Request) {
 		hasFailedElection := false
 
 		var requestPayload data.ElectLeaderRequest
-		eo.ab.readJSON(w, r, &requestPayload)
+		be.ab.readJSON(w, r, &requestPayload)
 
 		incomingPortNumber, _ := strconv.Atoi(requestPayload.IncomingPort)
 		currentPortNumber, _ := strconv.Atoi(portStr)
@@ -50,13 +103,20 @@ func (eo *ElectionOps) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
 		payload := data.ElectLeaderResponse{
 			IsSuccess: strconv.FormatBool(incomingPortNumber > currentPortNumber),
 		}
-		metadata, _ := eo.ab.ZTree.GetLocalMetadata()
-		allServers := strings.Split(metadata.Servers, ",")
+		local, _ := be.ab.ZTree.GetLocalState()
+		allServers := strings.Split(local.Servers, ",")
+
+		// Observers never stand for election
+		if be.ab.IsObserver(portStr) {
+			payload.IsSuccess = "true"
+			_ = be.ab.writeJSON(w, http.StatusOK, payload)
+			return
+		}
 
 		// If it has a better node number than the incoming one, send a value upwards to all nodes higher than it.
 		if incomingPortNumber <= currentPortNumber {
 			// Send self elect message to all nodes that is higher than current node
-			for _, outgoingPort := range allServers {
+			for _, outgoingPort := range be.ab.votingMembers(allServers) {
 				outgoingPortNumber, _ := strconv.Atoi(outgoingPort)
 				if outgoingPortNumber < currentPortNumber || outgoingPortNumber == currentPortNumber {
 					continue
@@ -66,7 +126,7 @@ func (eo *ElectionOps) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
 				client := &http.Client{}
 				portURL := fmt.Sprintf("%s", outgoingPort)
 
-				url := fmt.Sprintf(eo.ab.BaseURL + ":" + portURL + "/electLeader")
+				url := be.ab.peerURL(portURL) + "/electLeader"
 				var electMessage = data.ElectLeaderRequest{
 					IncomingPort: fmt.Sprintf("%d", currentPortNumber),
 				}
@@ -116,25 +176,79 @@ func (eo *ElectionOps) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
 
 		// Declare itself leader to all other nodes if node succeeds
 		if !hasFailedElection {
-			eo.ab.declareLeaderRequest(portStr, allServers)
+			be.ab.declareLeaderRequest(portStr, be.ab.nextEpoch(be.ab.Epoch()), allServers)
 		}
-		_ = eo.ab.writeJSON(w, http.StatusOK, payload)
+		_ = be.ab.writeJSON(w, http.StatusOK, payload)
 
 		// Sync metadata on restart
-		eo.ab.syncMetadata()
+		be.ab.syncMetadata()
 	}
 }
 
 // DeclareLeaderReceive handler to update Ensemble information once Bully terminate
 func (eo *ElectionOps) DeclareLeaderReceive() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		zNode, _ := eo.ab.ZTree.GetLocalMetadata()
+		local, _ := eo.ab.ZTree.GetLocalState()
 
 		var requestPayload data.DeclareLeaderRequest
 		eo.ab.readJSON(w, r, &requestPayload)
 
 		leaderPort := requestPayload.IncomingPort
-		color.Cyan("%s updating Leader to %s", zNode.NodePort, leaderPort)
-		eo.ab.ZTree.UpdateFirstLeader(leaderPort)
+		accepted, err := eo.ab.acceptEpoch(requestPayload.Epoch)
+		if err == nil && !accepted {
+			color.Red("%s ignoring Leader %s of epoch %d, already accepted epoch %d", local.NodePort, leaderPort, requestPayload.Epoch, eo.ab.AcceptedEpoch())
+			w.Header().Set("X-Epoch", strconv.Itoa(eo.ab.AcceptedEpoch()))
+			eo.ab.WriteError(w, ErrStaleEpoch)
+			return
+		}
+		if err == nil {
+			err = eo.ab.SetEpoch(requestPayload.Epoch)
+		}
+		if err != nil {
+			// Following a Leader of an epoch that would be forgotten on restart breaks the fencing
+			color.Red("%s not following Leader %s of epoch %d: %s", local.NodePort, leaderPort, requestPayload.Epoch, err)
+			eo.ab.WriteError(w, err)
+			return
+		}
+		color.Cyan("%s updating Leader to %s", local.NodePort, leaderPort)
+		eo.ab.ZTree.UpdateLeader(leaderPort)
+	}
+}
+
+// PreVote handler for a rejoining ZooWeeper server to learn the Leader it should stick to
+func (eo *ElectionOps) PreVote(w http.ResponseWriter, _ *http.Request) {
+	local, _ := eo.ab.ZTree.GetLocalState()
+
+	payload := data.PreVoteResponse{
+		Leader: local.Leader,
+		Epoch:  eo.ab.Epoch(),
+	}
+	_ = eo.ab.writeJSON(w, http.StatusOK, payload)
+}
+
+// Vote handler for Fast Leader Election, reply with the current vote of this round and own credentials
+func (eo *ElectionOps) Vote(w http.ResponseWriter, r *http.Request) {
+	var requestPayload data.VoteRequest
+	eo.ab.readJSON(w, r, &requestPayload)
+
+	credentials := eo.ab.credentials()
+	round, vote := eo.ab.ElectionVote()
+	if requestPayload.Round > round {
+		// Join the newer round with a fresh vote for itself
+		round, vote = requestPayload.Round, credentials
+	}
+	if requestPayload.Round == round && isBetterVote(requestPayload.Vote, vote) {
+		vote = requestPayload.Vote
+	}
+	if err := eo.ab.SetElectionVote(round, vote); err != nil {
+		eo.ab.WriteError(w, err)
+		return
+	}
+
+	payload := data.VoteResponse{
+		Round:       round,
+		Vote:        vote,
+		Credentials: credentials,
 	}
+	_ = eo.ab.writeJSON(w, http.StatusOK, payload)
 }
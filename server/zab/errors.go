@@ -0,0 +1,105 @@
+package zab
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ZabError is a structured error returned to the client (Kafka broker) with an HTTP status and an error code
+type ZabError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ZabError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrProposalTimeout = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "PROPOSAL_TIMEOUT",
+		Message: "proposal was not acknowledged by a quorum before its deadline",
+	}
+	ErrReadOnly = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "READ_ONLY",
+		Message: "server lost contact with a quorum and only serves possibly stale reads",
+	}
+	ErrNoLeader = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "NO_LEADER",
+		Message: "no Leader is currently elected",
+	}
+	ErrLeaseExpired = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "LEASE_EXPIRED",
+		Message: "leader has not heard from a quorum within its lease, linearizable read refused",
+	}
+	ErrSyncTimeout = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "SYNC_TIMEOUT",
+		Message: "server did not catch up with the Leader in time",
+	}
+	ErrStaleEpoch = &ZabError{
+		Status:  http.StatusConflict,
+		Code:    "STALE_EPOCH",
+		Message: "message from an older epoch, the sender is no longer the Leader",
+	}
+	ErrNotLeader = &ZabError{
+		Status:  http.StatusConflict,
+		Code:    "NOT_LEADER",
+		Message: "sender is not the current Leader",
+	}
+	ErrLeaderTransfer = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "LEADER_TRANSFER",
+		Message: "leadership is being transferred, retry shortly",
+	}
+	ErrLeaderChanged = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "LEADER_CHANGED",
+		Message: "server is no longer the Leader, retry on the current one",
+	}
+	ErrDraining = &ZabError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "DRAINING",
+		Message: "server is draining before a shutdown, use another server",
+	}
+	ErrHistoryPurged = &ZabError{
+		Status:  http.StatusGone,
+		Code:    "HISTORY_PURGED",
+		Message: "versions at this zxid or time were already purged by the retention",
+	}
+	ErrNoNode = &ZabError{
+		Status:  http.StatusNotFound,
+		Code:    "NO_NODE",
+		Message: "no ZNode for this client",
+	}
+	ErrInvalidAsOf = &ZabError{
+		Status:  http.StatusBadRequest,
+		Code:    "INVALID_AS_OF",
+		Message: "asOfZxid must be a positive zxid and asOfTime an RFC 3339 time",
+	}
+	ErrCommitFailed = &ZabError{
+		Status:  http.StatusInternalServerError,
+		Code:    "COMMIT_FAILED",
+		Message: "leader failed to commit an acknowledged proposal",
+	}
+)
+
+// WriteError as a JSONResponse, using the status and code of a ZabError
+func (ab *AtomicBroadcast) WriteError(w http.ResponseWriter, err error) {
+	var zabErr *ZabError
+	if !errors.As(err, &zabErr) {
+		zabErr = &ZabError{Status: http.StatusInternalServerError, Code: "INTERNAL", Message: err.Error()}
+	}
+
+	payload := JSONResponse{
+		Error:   true,
+		Code:    zabErr.Code,
+		Message: zabErr.Message,
+	}
+	_ = ab.writeJSON(w, zabErr.Status, payload)
+}
@@ -0,0 +1,107 @@
+package zab
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// PhiAccrualDetector learns the inter-arrival times of heartbeats from a server and outputs a suspicion level phi
+// instead of a binary alive/dead, so a single slow heartbeat does not trigger an election
+// (Ref: https://doi.org/10.1109/RELDIS.2004.1353004)
+type PhiAccrualDetector struct {
+	// MinStdDeviation keeps phi from exploding when heartbeats arrive at a very regular rate
+	MinStdDeviation time.Duration
+	WindowSize      int
+
+	intervals   []float64
+	lastArrival time.Time
+	mu          sync.Mutex
+}
+
+// minSamples before phi is trusted, until then the caller falls back to a fixed timeout
+const minSamples = 3
+
+func NewPhiAccrualDetector(minStdDeviation time.Duration) *PhiAccrualDetector {
+	return &PhiAccrualDetector{
+		MinStdDeviation: minStdDeviation,
+		WindowSize:      100,
+	}
+}
+
+// Heartbeat records an arrival, learning the interval since the previous one
+func (d *PhiAccrualDetector) Heartbeat(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.lastArrival.IsZero() {
+		d.intervals = append(d.intervals, float64(now.Sub(d.lastArrival).Milliseconds()))
+		if len(d.intervals) > d.WindowSize {
+			d.intervals = d.intervals[1:]
+		}
+	}
+	d.lastArrival = now
+}
+
+// Phi at the given time, 0 while not enough heartbeats were seen
+func (d *PhiAccrualDetector) Phi(now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.intervals) < minSamples {
+		return 0
+	}
+	mean, stdDeviation := d.stats()
+	elapsed := float64(now.Sub(d.lastArrival).Milliseconds())
+
+	// Logistic approximation of the normal CDF, as used by Akka and Cassandra
+	y := (elapsed - mean) / stdDeviation
+	exponent := -y * (1.5976 + 0.070566*y*y)
+	e := math.Exp(exponent)
+	if elapsed > mean {
+		// -log10(e / (1 + e)) without underflow once the heartbeat is long overdue
+		return -exponent/math.Ln10 + math.Log10(1+e)
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Ready once enough heartbeats were seen for Phi to be meaningful
+func (d *PhiAccrualDetector) Ready() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.intervals) >= minSamples
+}
+
+// Stats of the learnt intervals: number of samples, mean and standard deviation, and the last arrival
+func (d *PhiAccrualDetector) Stats() (int, time.Duration, time.Duration, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.intervals) == 0 {
+		return 0, 0, 0, d.lastArrival
+	}
+	mean, stdDeviation := d.stats()
+	return len(d.intervals), time.Duration(mean) * time.Millisecond, time.Duration(stdDeviation) * time.Millisecond, d.lastArrival
+}
+
+func (d *PhiAccrualDetector) stats() (float64, float64) {
+	sum := 0.0
+	for _, interval := range d.intervals {
+		sum += interval
+	}
+	mean := sum / float64(len(d.intervals))
+
+	variance := 0.0
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(d.intervals))
+
+	stdDeviation := math.Sqrt(variance)
+	// Never below 1 millisecond, perfectly regular heartbeats would otherwise make phi NaN
+	minStdDeviation := math.Max(float64(d.MinStdDeviation.Milliseconds()), 1)
+	if stdDeviation < minStdDeviation {
+		stdDeviation = minStdDeviation
+	}
+	return mean, stdDeviation
+}
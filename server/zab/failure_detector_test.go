@@ -0,0 +1,86 @@
+package zab
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// heartbeats at the given intervals in milliseconds, returning the last arrival
+func heartbeats(d *PhiAccrualDetector, start time.Time, intervals ...int) time.Time {
+	now := start
+	d.Heartbeat(now)
+	for _, interval := range intervals {
+		now = now.Add(time.Duration(interval) * time.Millisecond)
+		d.Heartbeat(now)
+	}
+	return now
+}
+
+func TestPhiReady(t *testing.T) {
+	d := NewPhiAccrualDetector(100 * time.Millisecond)
+	start := time.Now()
+	last := heartbeats(d, start, 1000, 1000)
+	if d.Ready() {
+		t.Fatalf("ready after %d intervals", minSamples-1)
+	}
+	if phi := d.Phi(last.Add(time.Minute)); phi != 0 {
+		t.Fatalf("phi %.2f before ready", phi)
+	}
+
+	last = last.Add(time.Second)
+	d.Heartbeat(last)
+	if !d.Ready() {
+		t.Fatalf("not ready after %d intervals", minSamples)
+	}
+	if phi := d.Phi(last.Add(time.Minute)); phi < 8 {
+		t.Fatalf("phi %.2f after a minute of silence", phi)
+	}
+}
+
+func TestPhiGrowsWithSilence(t *testing.T) {
+	d := NewPhiAccrualDetector(100 * time.Millisecond)
+	last := heartbeats(d, time.Now(), 900, 1100, 1000, 950, 1050, 1000)
+
+	previous := -1.0
+	for _, silence := range []int{0, 500, 1000, 1500, 2000, 3000, 5000, 60000} {
+		phi := d.Phi(last.Add(time.Duration(silence) * time.Millisecond))
+		if math.IsNaN(phi) || math.IsInf(phi, 0) {
+			t.Fatalf("phi %f after %dms", phi, silence)
+		}
+		if phi <= previous {
+			t.Fatalf("phi %.2f after %dms not above %.2f", phi, silence, previous)
+		}
+		previous = phi
+	}
+
+	if phi := d.Phi(last.Add(time.Second)); phi > 1 {
+		t.Fatalf("phi %.2f for a heartbeat on time", phi)
+	}
+	if phi := d.Phi(last.Add(3 * time.Second)); phi < 8 {
+		t.Fatalf("phi %.2f for a heartbeat 2s overdue", phi)
+	}
+}
+
+func TestPhiZeroVariance(t *testing.T) {
+	for minStdDeviation, want := range map[time.Duration]time.Duration{0: time.Millisecond, 250 * time.Millisecond: 250 * time.Millisecond} {
+		d := NewPhiAccrualDetector(minStdDeviation)
+		last := heartbeats(d, time.Now(), 1000, 1000, 1000, 1000)
+		if _, _, stdDeviation, _ := d.Stats(); stdDeviation != want {
+			t.Fatalf("standard deviation %s with min %s", stdDeviation, minStdDeviation)
+		}
+
+		for _, silence := range []int{500, 1000, 1001, 3000} {
+			phi := d.Phi(last.Add(time.Duration(silence) * time.Millisecond))
+			if math.IsNaN(phi) || math.IsInf(phi, 0) {
+				t.Fatalf("phi %f after %dms with min %s", phi, silence, minStdDeviation)
+			}
+		}
+		if phi := d.Phi(last.Add(time.Second)); math.Abs(phi-math.Log10(2)) > 0.01 {
+			t.Fatalf("phi %.2f at the mean interval with min %s", phi, minStdDeviation)
+		}
+		if phi := d.Phi(last.Add(3 * time.Second)); phi < 8 {
+			t.Fatalf("phi %.2f for a heartbeat 2s overdue with min %s", phi, minStdDeviation)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package zab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastLeaderElection elects the most up-to-date server, votes are ordered by (Epoch, Zxid, ServerId)
+// (Ref: https://zookeeper.apache.org/doc/current/zookeeperInternals.html#sc_leaderElection)
+type FastLeaderElection struct {
+	ab *AtomicBroadcast
+}
+
+func (fle *FastLeaderElection) Name() string {
+	return "fast"
+}
+
+// SelfElectLeaderRequest handler for Fast Leader Election, collecting votes from all servers in a new round
+func (fle *FastLeaderElection) SelfElectLeaderRequest(portStr string) http.HandlerFunc {
+	const REQUEST_TIMEOUT = 10
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload data.ElectLeaderRequest
+		fle.ab.readJSON(w, r, &requestPayload)
+
+		local, _ := fle.ab.ZTree.GetLocalState()
+		allServers := strings.Split(local.Servers, ",")
+		votingServers := fle.ab.votingMembers(allServers)
+
+		round, err := fle.ab.nextElectionRound()
+		if err != nil {
+			color.Red("%s could not start an election round: %s", portStr, err)
+			_ = fle.ab.writeJSON(w, http.StatusOK, data.ElectLeaderResponse{IsSuccess: "false"})
+			return
+		}
+		best := fle.ab.credentials()
+		responses := map[string]bool{portStr: true}
+
+		for _, outgoingPort := range votingServers {
+			if outgoingPort == portStr {
+				continue
+			}
+
+			voteRequest := data.VoteRequest{
+				Round: round,
+				Vote:  best,
+			}
+			jsonData, _ := json.Marshal(voteRequest)
+
+			color.Cyan("%s requesting Vote from %s for round %d", portStr, outgoingPort, round)
+			req, _ := http.NewRequest("POST", fle.ab.peerURL(outgoingPort)+"/vote", bytes.NewBuffer(jsonData))
+			req.Header.Add("Accept", "application/json")
+			req.Header.Add("Content-Type", "application/json")
+
+			ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT*time.Second)
+			req = req.WithContext(ctx)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				cancel()
+				color.Red("Timeout from %s", outgoingPort)
+				continue
+			}
+			resBody, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			cancel()
+			if resp.StatusCode != http.StatusOK {
+				color.Red("%s did not vote: %s", outgoingPort, resBody)
+				continue
+			}
+
+			var responseObject data.VoteResponse
+			if err := json.Unmarshal(resBody, &responseObject); err != nil {
+				continue
+			}
+			responses[outgoingPort] = true
+			if isBetterVote(responseObject.Credentials, best) {
+				best = responseObject.Credentials
+			}
+		}
+
+		// Only a quorum of responses can decide on the Leader
+		hasWonElection := false
+		if !fle.ab.quorumVerifier(votingServers).ContainsQuorum(responses) {
+			color.Red("%s only received %d of %d votes, no Leader elected", portStr, len(responses), len(votingServers))
+		} else if err := fle.ab.SetElectionVote(round, best); err != nil {
+			color.Red("%s could not record its vote for %s, no Leader elected: %s", portStr, best.ServerId, err)
+		} else {
+			color.Cyan("%s elected %s with epoch %d and zxid %d", portStr, best.ServerId, best.Epoch, best.Zxid)
+			fle.ab.declareLeaderRequest(best.ServerId, fle.ab.nextEpoch(best.Epoch), allServers)
+			hasWonElection = best.ServerId == portStr
+		}
+
+		payload := data.ElectLeaderResponse{
+			IsSuccess: strconv.FormatBool(hasWonElection),
+		}
+		_ = fle.ab.writeJSON(w, http.StatusOK, payload)
+
+		// Sync metadata on restart
+		fle.ab.syncMetadata()
+	}
+}
+
+// isBetterVote compares 2 votes by Epoch, then Zxid, then ServerId
+func isBetterVote(a, b data.Vote) bool {
+	if a.Epoch != b.Epoch {
+		return a.Epoch > b.Epoch
+	}
+	if a.Zxid != b.Zxid {
+		return a.Zxid > b.Zxid
+	}
+	aId, _ := strconv.Atoi(a.ServerId)
+	bId, _ := strconv.Atoi(b.ServerId)
+	return aId > bId
+}
@@ -0,0 +1,56 @@
+package zab
+
+import (
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"net/http"
+	"strconv"
+)
+
+// CheckEpoch of an intra-ensemble message from its X-Epoch header, a message without one or from a lower epoch than
+// the current one comes from a Leader that was replaced, e.g. while partitioned, and must not be applied
+func (ab *AtomicBroadcast) CheckEpoch(r *http.Request) error {
+	epoch, err := strconv.Atoi(r.Header.Get("X-Epoch"))
+	if err != nil {
+		color.Red("Rejecting %s from %s without epoch", r.URL.Path, r.Header.Get("X-Sender-Port"))
+		return ErrStaleEpoch
+	}
+	if current := ab.Epoch(); epoch < current {
+		color.Red("Rejecting %s from %s of epoch %d, current epoch %d", r.URL.Path, r.Header.Get("X-Sender-Port"), epoch, current)
+		return ErrStaleEpoch
+	}
+	return nil
+}
+
+// checkFenced response of another server, stepping down if it rejected this server as a Leader of an older epoch
+func (ab *AtomicBroadcast) checkFenced(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusConflict {
+		return false
+	}
+	epoch, err := strconv.Atoi(resp.Header.Get("X-Epoch"))
+	if err != nil || epoch <= ab.Epoch() {
+		return false
+	}
+	ab.stepDown(epoch)
+	return true
+}
+
+// stepDown once another server is in a newer epoch, looking for the current Leader instead
+func (ab *AtomicBroadcast) stepDown(epoch int) {
+	if _, err := ab.acceptEpoch(epoch); err != nil {
+		// Stepping down is still safe, the newer epoch is learnt again from its Leader
+		color.Red("Failed to accept epoch %d: %s", epoch, err)
+	}
+
+	local, _ := ab.ZTree.GetLocalState()
+	if local.NodePort != local.Leader {
+		return
+	}
+	color.Red("Leader %s fenced by epoch %d, stepping down", local.NodePort, epoch)
+	ab.ZTree.UpdateLeader("")
+	ab.abortProposal()
+
+	go func() {
+		ab.ErrorLeaderChan <- data.HealthCheckError{ErrorPort: local.NodePort, IsWakeup: true}
+	}()
+}
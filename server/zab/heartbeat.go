@@ -0,0 +1,312 @@
+package zab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StartHealthCheck with Leader-driven heartbeats: every TickTime the Leader heartbeats its Followers with its zxid and
+// digest for them to detect a divergence, while Followers only watch the Leader and write to ErrorLeaderChan once its
+// PhiAccrualDetector exceeds PhiThreshold, or no heartbeat arrived for SyncLimit ticks while the detector is still
+// learning
+// (Ref: tickTime and syncLimit in https://zookeeper.apache.org/doc/current/zookeeperAdmin.html)
+func (ab *AtomicBroadcast) StartHealthCheck() {
+	var lastLeader string
+	var leaderSince time.Time
+	for {
+		time.Sleep(ab.TickTime)
+		if ab.healthChecksStopped() {
+			continue
+		}
+		local, _ := ab.ZTree.GetLocalState()
+
+		if local.NodePort == local.Leader {
+			ab.sendHeartbeats(local.NodePort, strings.Split(local.Servers, ","))
+			continue
+		}
+		if local.Leader == "" {
+			continue
+		}
+
+		// A newly elected Leader gets SyncLimit ticks to send its first heartbeat
+		if local.Leader != lastLeader {
+			lastLeader = local.Leader
+			leaderSince = time.Now()
+			ab.resetDetector(local.Leader)
+		}
+		_, at := ab.LastLeaderHeartbeat()
+		if at.Before(leaderSince) {
+			at = leaderSince
+		}
+
+		detector := ab.detector(local.Leader)
+		if detector.Ready() {
+			phi := detector.Phi(time.Now())
+			if phi < ab.PhiThreshold {
+				continue
+			}
+			color.Red("%s suspects Leader %s with phi %.2f after %s", local.NodePort, local.Leader, phi, time.Since(at).Round(time.Millisecond))
+		} else {
+			if time.Since(at) < ab.syncLimitDuration() {
+				continue
+			}
+			color.Red("%s missed heartbeats from Leader %s for %s", local.NodePort, local.Leader, time.Since(at).Round(time.Second))
+		}
+		leaderSince = time.Now()
+		ab.resetDetector(local.Leader)
+		select {
+		case ab.ErrorLeaderChan <- data.HealthCheckError{ErrorPort: local.Leader}:
+		default:
+			// An election is already running
+		}
+	}
+}
+
+// sendHeartbeats from the Leader to all Followers and Observers, recording their liveness and lag
+func (ab *AtomicBroadcast) sendHeartbeats(leader string, servers []string) {
+	treeDigest, _ := ab.ZTree.GetDigest()
+	heartbeat := data.Heartbeat{
+		LeaderPort:   leader,
+		Epoch:        ab.Epoch(),
+		Zxid:         treeDigest.Zxid,
+		Digest:       treeDigest.Digest,
+		PurgedDigest: treeDigest.PurgedDigest,
+		HasQuorum:    ab.HasQuorum(),
+	}
+	jsonData, _ := json.Marshal(heartbeat)
+
+	for _, port := range servers {
+		if port == leader {
+			continue
+		}
+
+		go func(port string) {
+			ctx, cancel := context.WithTimeout(context.Background(), ab.TickTime)
+			defer cancel()
+
+			req, _ := http.NewRequestWithContext(ctx, "POST", ab.peerURL(port)+"/heartbeat", bytes.NewBuffer(jsonData))
+			req.Header.Add("Accept", "application/json")
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("X-Sender-Port", leader)
+			req.Header.Add("X-Epoch", strconv.Itoa(heartbeat.Epoch))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				color.Red("Leader %s missed heartbeat ack from %s", leader, port)
+				return
+			}
+			defer resp.Body.Close()
+			if ab.checkFenced(resp) {
+				return
+			}
+
+			var ack data.HeartbeatAck
+			if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+				return
+			}
+			ab.recordHeartbeat(port)
+			ab.recordFollowerZxid(port, ack.Zxid, ack.Diverged)
+		}(port)
+	}
+}
+
+// FollowerStatus for the Leader to expose liveness and lag of each Follower and Observer
+func (ab *AtomicBroadcast) FollowerStatus() []data.FollowerStatus {
+	local, _ := ab.ZTree.GetLocalState()
+	highestZNodeId, _ := ab.ZTree.GetHighestZNodeId()
+
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+
+	var statuses []data.FollowerStatus
+	for _, port := range strings.Split(local.Servers, ",") {
+		if port == local.NodePort {
+			continue
+		}
+		status := data.FollowerStatus{
+			Port:     port,
+			Observer: ab.observers[port],
+		}
+		if lastContact, ok := ab.lastContact[port]; ok {
+			status.LastHeartbeatAck = lastContact.Format(time.RFC3339)
+			status.Alive = time.Since(lastContact) < ab.syncLimitDuration()
+		}
+		if zxid, ok := ab.followerZxid[port]; ok {
+			status.Zxid = zxid
+			status.Lag = highestZNodeId - zxid
+		}
+		status.Diverged = ab.followerDiverged[port]
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// PhiStatus of every server this one receives heartbeats from: the Leader on a Follower, all Followers on the Leader
+func (ab *AtomicBroadcast) PhiStatus() []data.PhiStatus {
+	ab.healthMu.Lock()
+	detectors := make(map[string]*PhiAccrualDetector)
+	ports := make(map[string]bool)
+	for port, detector := range ab.detectors {
+		detectors[port] = detector
+		ports[port] = true
+	}
+	ab.healthMu.Unlock()
+
+	now := time.Now()
+	var statuses []data.PhiStatus
+	for _, port := range sortedPorts(ports) {
+		detector := detectors[port]
+		samples, mean, stdDeviation, lastArrival := detector.Stats()
+		phi := math.Round(detector.Phi(now)*100) / 100
+		status := data.PhiStatus{
+			Port:         port,
+			Phi:          phi,
+			Suspected:    detector.Ready() && phi >= ab.PhiThreshold,
+			Samples:      samples,
+			MeanInterval: mean.Milliseconds(),
+			StdDeviation: stdDeviation.Milliseconds(),
+		}
+		if !lastArrival.IsZero() {
+			status.LastHeartbeat = lastArrival.Format(time.RFC3339Nano)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (ab *AtomicBroadcast) syncLimitDuration() time.Duration {
+	return ab.TickTime * time.Duration(ab.SyncLimit)
+}
+
+// WatchQuorum for the Leader to step down once it lost contact with a quorum for longer than QuorumLossTimeout,
+// servers without a quorum turn read-only if ReadOnlyMode is enabled. A server left without Leader looks for one again
+// once it reaches a quorum.
+func (ab *AtomicBroadcast) WatchQuorum(port int) {
+	var lostSince, retryAt time.Time
+	var lastLeader string
+	for {
+		time.Sleep(time.Second)
+		if ab.healthChecksStopped() {
+			continue
+		}
+		local, _ := ab.ZTree.GetLocalState()
+		if local.Leader != lastLeader && !lostSince.IsZero() {
+			// A newly elected Leader gets the full timeout to hear from its Followers
+			lostSince = time.Now()
+		}
+		lastLeader = local.Leader
+
+		if local.Leader == "" && time.Now().After(retryAt) {
+			// Stepped down earlier, no heartbeat or declare may ever arrive to start an election
+			retryAt = time.Now().Add(ab.TickTime)
+			if ab.quorumReachable(local.NodePort, strings.Split(local.Servers, ",")) {
+				color.Green("%d reaches a quorum again, looking for the Leader", port)
+				retryAt = time.Now().Add(ab.syncLimitDuration())
+				select {
+				case ab.ErrorLeaderChan <- data.HealthCheckError{ErrorPort: local.NodePort, IsWakeup: true}:
+				default:
+					// An election is already running
+				}
+			}
+		}
+
+		if ab.HasQuorum() {
+			if !lostSince.IsZero() {
+				color.Green("%d regained quorum", port)
+				lostSince = time.Time{}
+				ab.SetReadOnly(false)
+			}
+			continue
+		}
+
+		if lostSince.IsZero() {
+			lostSince = time.Now()
+		}
+		if time.Since(lostSince) < ab.QuorumLossTimeout {
+			continue
+		}
+
+		if local.NodePort == local.Leader {
+			color.Red("Leader %s lost quorum for %s, stepping down", local.NodePort, ab.QuorumLossTimeout)
+			ab.ZTree.UpdateLeader("")
+		}
+		if ab.ReadOnlyMode && !ab.ReadOnly() {
+			color.Red("%s lost quorum, serving read-only", local.NodePort)
+			ab.SetReadOnly(true)
+		}
+	}
+}
+
+// HasQuorum if the Leader and the voting members it heard from within QuorumLossTimeout form a quorum
+func (ab *AtomicBroadcast) HasQuorum() bool {
+	return ab.hasQuorumWithin(ab.QuorumLossTimeout)
+}
+
+// HasLeaderLease if this server is the Leader and heard from a quorum within its leaderLease
+func (ab *AtomicBroadcast) HasLeaderLease() bool {
+	local, _ := ab.ZTree.GetLocalState()
+	return local.NodePort == local.Leader && ab.hasQuorumWithin(ab.leaderLease())
+}
+
+// leaderLease during which no Follower can have started an election: LeaderLease if set, otherwise the election
+// timeout of SyncLimit ticks less MaxClockDrift between the clocks of the servers
+func (ab *AtomicBroadcast) leaderLease() time.Duration {
+	if ab.LeaderLease > 0 {
+		return ab.LeaderLease
+	}
+	return ab.syncLimitDuration() - ab.MaxClockDrift
+}
+
+// ValidateLeaderLease rejects a leaderLease that could last until the election timeout, the Leader would then serve
+// linearizable reads while another one may already be elected
+func (ab *AtomicBroadcast) ValidateLeaderLease() error {
+	electionTimeout := ab.syncLimitDuration()
+	lease := ab.leaderLease()
+	if lease <= 0 || lease >= electionTimeout || lease+ab.MaxClockDrift > electionTimeout {
+		return fmt.Errorf("leader lease %s must be shorter than the election timeout %s (tickTime × syncLimit) "+
+			"less the max clock drift %s", lease, electionTimeout, ab.MaxClockDrift)
+	}
+	return nil
+}
+
+// quorumReachable if the voting members answering a ping form a quorum with this server
+func (ab *AtomicBroadcast) quorumReachable(nodePort string, servers []string) bool {
+	members := ab.votingMembers(servers)
+	acks := map[string]bool{nodePort: true}
+	for _, port := range members {
+		if port != nodePort && ab.isAlive(port) {
+			acks[port] = true
+		}
+	}
+	return ab.quorumVerifier(members).ContainsQuorum(acks)
+}
+
+func (ab *AtomicBroadcast) hasQuorumWithin(timeout time.Duration) bool {
+	local, _ := ab.ZTree.GetLocalState()
+	if local.NodePort != local.Leader {
+		// Followers only watch the Leader, which tells in its heartbeat whether it still has a quorum
+		heartbeat, at := ab.LastLeaderHeartbeat()
+		return local.Leader != "" && time.Since(at) < timeout && heartbeat.HasQuorum
+	}
+	members := ab.votingMembers(strings.Split(local.Servers, ","))
+
+	ab.healthMu.Lock()
+	acks := map[string]bool{local.NodePort: true}
+	for port, lastContact := range ab.lastContact {
+		if time.Since(lastContact) < timeout {
+			acks[port] = true
+		}
+	}
+	ab.healthMu.Unlock()
+
+	return ab.quorumVerifier(members).ContainsQuorum(acks)
+}
@@ -0,0 +1,40 @@
+package zab
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateLeaderLease(t *testing.T) {
+	tests := []struct {
+		name        string
+		leaderLease time.Duration
+		clockDrift  time.Duration
+		want        time.Duration
+		valid       bool
+	}{
+		{"derived from the election timeout", 0, 500 * time.Millisecond, 9500 * time.Millisecond, true},
+		{"without clock drift", 0, 0, 10 * time.Second, false},
+		{"shorter lease", 5 * time.Second, 500 * time.Millisecond, 5 * time.Second, true},
+		{"lease of the election timeout", 10 * time.Second, 0, 10 * time.Second, false},
+		{"lease and drift beyond the election timeout", 10 * time.Second, 500 * time.Millisecond, 10 * time.Second, false},
+		{"lease beyond the election timeout", 15 * time.Second, 0, 15 * time.Second, false},
+		{"drift beyond the election timeout", 0, 10 * time.Second, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ab := &AtomicBroadcast{
+				TickTime:      2 * time.Second,
+				SyncLimit:     5,
+				LeaderLease:   test.leaderLease,
+				MaxClockDrift: test.clockDrift,
+			}
+			if got := ab.leaderLease(); got != test.want {
+				t.Fatalf("lease %s, want %s", got, test.want)
+			}
+			if err := ab.ValidateLeaderLease(); (err == nil) != test.valid {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
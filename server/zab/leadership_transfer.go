@@ -0,0 +1,129 @@
+package zab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/ztree"
+	"strings"
+	"time"
+)
+
+// TransferLeadership from this Leader to a Follower, or to the most up-to-date one if target is empty: new Write
+// Request are refused with ErrLeaderTransfer, in-flight proposals are drained, the target is caught up and finally
+// declared Leader of a new epoch, so a rolling restart never waits for a failure to be detected
+func (ab *AtomicBroadcast) TransferLeadership(target string) (string, error) {
+	local, _ := ab.ZTree.GetLocalState()
+	if local.NodePort != local.Leader {
+		return "", ErrNotLeader
+	}
+	if !ab.startTransfer() {
+		return "", ErrLeaderTransfer
+	}
+	defer ab.endTransfer()
+
+	target, err := ab.transferTarget(local, target)
+	if err != nil {
+		return "", err
+	}
+	color.Magenta("Leader %s transferring leadership to %s", local.NodePort, target)
+
+	// Drain in-flight proposals, new ones are already refused
+	deadline := time.Now().Add(ab.ProposalTimeout)
+	for !ab.ProposalIdle() {
+		if time.Now().After(deadline) {
+			return "", ErrProposalTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := ab.catchUp(target); err != nil {
+		return "", err
+	}
+
+	ab.declareLeaderRequest(target, ab.nextEpoch(ab.Epoch()), strings.Split(local.Servers, ","))
+	color.Magenta("%s handed leadership to %s", local.NodePort, target)
+	return target, nil
+}
+
+// transferTarget validates the requested target, or picks the alive voting Follower with the highest zxid
+func (ab *AtomicBroadcast) transferTarget(local *ztree.LocalState, target string) (string, error) {
+	if target != "" {
+		if target == local.NodePort {
+			return "", fmt.Errorf("%s is already the Leader", target)
+		}
+		if !contains(strings.Split(local.Servers, ","), target) {
+			return "", fmt.Errorf("%s is not a member", target)
+		}
+		if ab.IsObserver(target) {
+			return "", fmt.Errorf("observer %s can not become Leader", target)
+		}
+		if !ab.isAlive(target) {
+			return "", fmt.Errorf("%s is not reachable", target)
+		}
+		return target, nil
+	}
+
+	best, bestZxid := "", -1
+	for _, status := range ab.FollowerStatus() {
+		if status.Observer || !status.Alive {
+			continue
+		}
+		if status.Zxid > bestZxid {
+			best, bestZxid = status.Port, status.Zxid
+		}
+	}
+	if best == "" {
+		return "", errors.New("no alive Follower to transfer leadership to")
+	}
+	return best, nil
+}
+
+// catchUp the target with every Metadata it is missing, then check it applied up to the highest ZNodeId
+func (ab *AtomicBroadcast) catchUp(target string) error {
+	highestZNodeId, _ := ab.ZTree.GetHighestZNodeId()
+	for attempt := 0; ; attempt++ {
+		targetZxid, err := ab.lastZxid(target)
+		if err != nil {
+			return err
+		}
+		if targetZxid >= highestZNodeId {
+			return nil
+		}
+		if attempt > 0 && time.Duration(attempt)*time.Second > ab.SyncTimeout {
+			return ErrSyncTimeout
+		}
+
+		color.Yellow("Leader catching up %s from %d to %d", target, targetZxid, highestZNodeId)
+		if err := ab.sendMissingMetadata(target, targetZxid); err != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// lastZxid of another server, its highest ZNodeId
+func (ab *AtomicBroadcast) lastZxid(port string) (int, error) {
+	url := ab.peerURL(port) + "/lastZxid"
+	resp, err := ab.sendRequest(url, "POST", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var metadata ztree.Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return 0, err
+	}
+	return metadata.NodeId, nil
+}
+
+func contains(ports []string, port string) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package zab
+
+import (
+	"fmt"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PARTICIPANT = "participant"
+	OBSERVER    = "observer"
+)
+
+// ApplyConfig of the ensemble from a CONFIG_FILE, taking precedence over environment variables
+func (ab *AtomicBroadcast) ApplyConfig(config *data.EnsembleConfig) {
+	ab.configMu.Lock()
+	ab.members = make(map[string]data.Member)
+	for _, member := range config.Members {
+		ab.members[strconv.Itoa(member.Id)] = member
+	}
+	ab.configMu.Unlock()
+
+	var observers []string
+	for _, member := range config.Members {
+		if member.Role == OBSERVER {
+			observers = append(observers, strconv.Itoa(member.Id))
+		}
+	}
+	ab.SetObservers(observers)
+
+	if config.TickTime > 0 {
+		ab.TickTime = time.Duration(config.TickTime) * time.Millisecond
+	}
+	if config.SyncLimit > 0 {
+		ab.SyncLimit = config.SyncLimit
+	}
+	if config.PhiThreshold > 0 {
+		ab.PhiThreshold = config.PhiThreshold
+	}
+	if config.ProposalTimeout > 0 {
+		ab.ProposalTimeout = time.Duration(config.ProposalTimeout) * time.Second
+	}
+	if config.QuorumLossTimeout > 0 {
+		ab.QuorumLossTimeout = time.Duration(config.QuorumLossTimeout) * time.Second
+	}
+	if config.LeaderLease > 0 {
+		ab.LeaderLease = time.Duration(config.LeaderLease) * time.Second
+	}
+	if config.MaxClockDrift > 0 {
+		ab.MaxClockDrift = time.Duration(config.MaxClockDrift) * time.Millisecond
+	}
+	if config.SyncTimeout > 0 {
+		ab.SyncTimeout = time.Duration(config.SyncTimeout) * time.Second
+	}
+	if config.RetentionVersions > 0 {
+		ab.RetentionVersions = config.RetentionVersions
+	}
+	if config.RetentionHours > 0 {
+		ab.RetentionHours = config.RetentionHours
+	}
+	if config.ElectionStrategy != "" {
+		ab.Election.Strategy = ab.electionStrategy(config.ElectionStrategy)
+	}
+	if config.Quorum != "" {
+		ab.Quorum = config.Quorum
+	}
+	if config.QuorumWeights != "" {
+		ab.QuorumWeights = config.QuorumWeights
+	}
+	if config.QuorumGroups != "" {
+		ab.QuorumGroups = config.QuorumGroups
+	}
+	if config.PreVote != nil {
+		ab.PreVote = *config.PreVote
+	}
+	if config.ReadOnlyMode != nil {
+		ab.ReadOnlyMode = *config.ReadOnlyMode
+	}
+}
+
+// peerURL of a server for messages within the ensemble, without a CONFIG_FILE the server ID is its port on BaseURL
+func (ab *AtomicBroadcast) peerURL(id string) string {
+	member, ok := ab.member(id)
+	if !ok {
+		return ab.BaseURL + ":" + id
+	}
+	return memberURL(member.Host, member.PeerPort)
+}
+
+// clientURL of a server for Read and Write Request, e.g. forwarded to the Leader
+func (ab *AtomicBroadcast) clientURL(id string) string {
+	member, ok := ab.member(id)
+	if !ok {
+		return ab.BaseURL + ":" + id
+	}
+	return memberURL(member.Host, member.ClientPort)
+}
+
+// configuredIds of the members of the CONFIG_FILE, nil without one
+func (ab *AtomicBroadcast) configuredIds() map[string]bool {
+	ab.configMu.Lock()
+	defer ab.configMu.Unlock()
+	if ab.members == nil {
+		return nil
+	}
+	ids := make(map[string]bool)
+	for id := range ab.members {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (ab *AtomicBroadcast) member(id string) (data.Member, bool) {
+	ab.configMu.Lock()
+	defer ab.configMu.Unlock()
+	member, ok := ab.members[id]
+	return member, ok
+}
+
+func memberURL(host string, port int) string {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
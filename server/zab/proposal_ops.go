@@ -3,6 +3,7 @@ package zab
 import (
 	"encoding/json"
 	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/ztree"
 	"net/http"
 	"strings"
 	"time"
@@ -15,77 +16,145 @@ type ProposalOps struct {
 
 // ProposeWrite handler on Follower nodes to ACK upon receive
 func (po *ProposalOps) ProposeWrite(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := po.ab.ZTree.GetLocalMetadata()
+	local, _ := po.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
-	if clientPort != zNode.Leader {
+	if clientPort != local.Leader {
 		color.Red("I only supposed to receive Propose Write from leader not from %s\n", clientPort)
+		po.ab.WriteError(w, ErrNotLeader)
+		return
 	}
 
 	data := po.ab.CreateMetadataFromPayload(w, r)
 	jsonData, _ := json.Marshal(data)
 
-	color.HiBlue("%s received Propose Write from %s\n", zNode.NodePort, clientPort)
-	color.HiBlue("%s sending proposalACK to %s\n", zNode.NodePort, clientPort)
-	url := po.ab.BaseURL + ":" + zNode.Leader + "/acknowledgeProposal"
+	color.HiBlue("%s received Propose Write from %s\n", local.NodePort, clientPort)
+	color.HiBlue("%s sending proposalACK to %s\n", local.NodePort, clientPort)
+	url := po.ab.peerURL(local.Leader) + "/acknowledgeProposal"
 	_, err = po.ab.sendRequest(url, "POST", jsonData)
 }
 
-// AcknowledgeProposal handler on Leader node to wait for majority ACK before commit
+// AcknowledgeProposal handler on Leader node to wait for a quorum of ACK before commit
 func (po *ProposalOps) AcknowledgeProposal(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := po.ab.ZTree.GetLocalMetadata()
+	local, _ := po.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
-	if clientPort == zNode.Leader {
+	if clientPort == local.Leader {
 		color.Red("I'm the Leader I'm not supposed to get acknowledged from myself\n")
 	}
-	color.HiBlue("Leader %s received ACK from Follower %s\n", zNode.NodePort, clientPort)
+	if po.ab.IsObserver(clientPort) {
+		color.Red("Observer %s is not supposed to ACK proposal\n", clientPort)
+		return
+	}
+	data := po.ab.CreateMetadataFromPayload(w, r)
+	color.HiBlue("Leader %s received ACK from Follower %s for proposal %d\n", local.NodePort, clientPort, data.ProposalId)
 
-	// Wait for majority of Follower to ACK
-	portsSlice := strings.Split(zNode.Servers, ",")
-	majority := len(portsSlice) / 2
+	// Wait for a quorum of Follower to ACK
+	portsSlice := po.ab.votingMembers(strings.Split(local.Servers, ","))
+	verifier := po.ab.quorumVerifier(portsSlice)
 
-	if po.ab.ProposalState() != ACKNOWLEDGED {
+	switch po.ab.ProposalState() {
+	case PROPOSED:
+		acks, ok := po.ab.AddAck(data.ProposalId, clientPort)
+		if !ok {
+			color.Red("Leader %s dropping late ACK of Follower %s for proposal %d\n", local.NodePort, clientPort, data.ProposalId)
+			return
+		}
 		for {
-			currentAckCount := po.ab.AckCounter()
-			currentAckCount++
-			po.ab.SetAckCounter(currentAckCount)
-
-			if currentAckCount > majority {
-				color.HiBlue("Leader %s received majority proposalAck, %d\n", zNode.NodePort, currentAckCount)
-				po.ab.SetAckCounter(0)
-				po.ab.SetProposalState(ACKNOWLEDGED)
+			if verifier.ContainsQuorum(acks) && po.ab.acknowledgeProposal() {
+				color.HiBlue("Leader %s received %s quorum proposalAck, %d\n", local.NodePort, verifier.Name(), len(acks))
 				break
-			} else if po.ab.ProposalState() == ACKNOWLEDGED {
+			}
+			state := po.ab.ProposalState()
+			if state == ACKNOWLEDGED || state == COMMITTED || !po.ab.isCurrentProposal(data.ProposalId) {
 				break
+			} else if state == ABORTED {
+				color.Red("Leader %s aborted proposal, not asking Follower %s to commit\n", local.NodePort, clientPort)
+				return
 			}
 			time.Sleep(100 * time.Millisecond)
+			acks = po.ab.Acks()
+		}
+	case ABORTED:
+		color.Red("Leader %s aborted proposal, not asking Follower %s to commit\n", local.NodePort, clientPort)
+		return
+	}
+	if !po.ab.isCurrentProposal(data.ProposalId) {
+		// ACKed once a later proposal started, whatever its state
+		color.Red("Leader %s dropping late ACK of Follower %s for proposal %d\n", local.NodePort, clientPort, data.ProposalId)
+		return
+	}
+	// Only once the Leader committed locally, so a Follower never commits a proposal the Leader then reports aborted
+	for {
+		committed, decided := po.ab.proposalOutcome(data.ProposalId)
+		if committed {
+			break
+		} else if decided {
+			color.Red("Leader %s did not commit proposal %d, not asking Follower %s to commit\n", local.NodePort, data.ProposalId, clientPort)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// For the Follower to compare its digest once it committed as well
+	if zxid, ok := po.ab.committedAt(data.ProposalId); ok {
+		if digest, found, _ := po.ab.ZTree.GetDigestAt(zxid); found {
+			data.Digest = &ztree.TreeDigest{Zxid: zxid, Digest: digest}
 		}
 	}
 
-	data := po.ab.CreateMetadataFromPayload(w, r)
 	jsonData, _ := json.Marshal(data)
 
-	color.HiBlue("Leader %s asking Follower %s to commit\n", zNode.NodePort, clientPort)
-	url := po.ab.BaseURL + ":" + clientPort + "/commitWrite"
-	_, err = po.ab.sendRequest(url, "POST", jsonData)
+	color.HiBlue("Leader %s asking Follower %s to commit\n", local.NodePort, clientPort)
+	url := po.ab.peerURL(clientPort) + "/commitWrite"
+	resp, err := po.ab.sendRequest(url, "POST", jsonData)
 	if err != nil {
 		color.HiBlue("Error Asking Follower %s to commit: %s\n", clientPort, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		po.ab.addCommit(data.ProposalId, clientPort)
 	}
 
 }
 
 // CommitWrite handler on Follower nodes to commit upon receive
 func (po *ProposalOps) CommitWrite(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := po.ab.ZTree.GetLocalMetadata()
+	local, _ := po.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
 
 	data := po.ab.CreateMetadataFromPayload(w, r)
 	jsonData, _ := json.Marshal(data)
 
-	color.HiBlue("%s receive Commit Write from %s\n", zNode.NodePort, clientPort)
-	color.HiBlue("%s Committing Write\n", zNode.NodePort)
-	url := po.ab.BaseURL + ":" + zNode.NodePort + "/writeMetadata"
-	_, err = po.ab.sendRequest(url, "POST", jsonData)
+	color.HiBlue("%s receive Commit Write from %s\n", local.NodePort, clientPort)
+	color.HiBlue("%s Committing Write\n", local.NodePort)
+	url := po.ab.peerURL(local.NodePort) + "/writeMetadata"
+	resp, err := po.ab.sendRequest(url, "POST", jsonData)
 	if err != nil {
 		color.Red("Error Commiting Write: %s\n", err.Error())
+		po.ab.WriteError(w, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+	if data.Digest != nil && clientPort == local.Leader {
+		po.ab.compareDigest(clientPort, data.Digest.Zxid, data.Digest.Digest)
+	}
+}
+
+// Inform handler on Observer nodes to commit a Transaction already committed by the quorum
+func (po *ProposalOps) Inform(w http.ResponseWriter, r *http.Request) {
+	local, _ := po.ab.ZTree.GetLocalState()
+	clientPort := r.Header.Get("X-Sender-Port")
+
+	data := po.ab.CreateMetadataFromPayload(w, r)
+	jsonData, _ := json.Marshal(data)
+
+	color.HiBlue("Observer %s receive Inform from %s\n", local.NodePort, clientPort)
+	url := po.ab.peerURL(local.NodePort) + "/writeMetadata"
+	_, err = po.ab.sendRequest(url, "POST", jsonData)
+	if err != nil {
+		color.Red("Error Commiting Inform: %s\n", err.Error())
 	}
 }
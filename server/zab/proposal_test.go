@@ -0,0 +1,50 @@
+package zab
+
+import (
+	"testing"
+)
+
+func TestNewProposalRefusedDuringTransfer(t *testing.T) {
+	ab := &AtomicBroadcast{proposalState: COMMITTED}
+	if !ab.startTransfer() {
+		t.Fatal("transfer not started")
+	}
+	if _, err := ab.newProposal("8082"); err != ErrLeaderTransfer {
+		t.Fatalf("got %v", err)
+	}
+	if ab.ProposalState() != COMMITTED {
+		t.Fatalf("state %s", ab.ProposalState())
+	}
+
+	ab.endTransfer()
+	if proposalId, err := ab.newProposal("8082"); err != nil || proposalId != 1 {
+		t.Fatalf("got %d, %v", proposalId, err)
+	}
+}
+
+func TestProposalOutcome(t *testing.T) {
+	ab := &AtomicBroadcast{proposalState: COMMITTED}
+	first, _ := ab.newProposal("8082")
+	if _, decided := ab.proposalOutcome(first); decided {
+		t.Fatal("decided before the Leader committed")
+	}
+	ab.commitProposal(first, 2)
+	if committed, _ := ab.proposalOutcome(first); !committed {
+		t.Fatal("not committed")
+	}
+
+	second, _ := ab.newProposal("8082")
+	ab.SetProposalState(ABORTED)
+	if committed, decided := ab.proposalOutcome(second); committed || !decided {
+		t.Fatalf("aborted proposal committed %v, decided %v", committed, decided)
+	}
+	if committed, _ := ab.proposalOutcome(first); !committed {
+		t.Fatal("earlier proposal no longer committed")
+	}
+
+	// Committed as a Follower of a Leader further ahead, later proposals never reuse its id
+	ab.commitProposal(10, 5)
+	if third, _ := ab.newProposal("8082"); third != 11 {
+		t.Fatalf("got proposal %d", third)
+	}
+}
@@ -0,0 +1,161 @@
+package zab
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// QuorumVerifier decides whether a set of voting members that ACKed forms a quorum
+// (Ref: https://zookeeper.apache.org/doc/current/zookeeperHierarchicalQuorums.html)
+type QuorumVerifier interface {
+	Name() string
+	ContainsQuorum(acks map[string]bool) bool
+}
+
+// MajorityQuorum needs more than half of the voting members
+type MajorityQuorum struct {
+	Members []string
+}
+
+func (mq *MajorityQuorum) Name() string {
+	return "majority"
+}
+
+func (mq *MajorityQuorum) ContainsQuorum(acks map[string]bool) bool {
+	count := 0
+	for _, port := range mq.Members {
+		if acks[port] {
+			count++
+		}
+	}
+	return count > len(mq.Members)/2
+}
+
+// WeightedQuorum needs more than half of the total weight of the voting members
+type WeightedQuorum struct {
+	Weights map[string]int
+}
+
+func (wq *WeightedQuorum) Name() string {
+	return "weighted"
+}
+
+func (wq *WeightedQuorum) ContainsQuorum(acks map[string]bool) bool {
+	return containsWeightedMajority(wq.Weights, acks)
+}
+
+// HierarchicalQuorum needs a weighted majority in more than half of the groups
+type HierarchicalQuorum struct {
+	Groups []map[string]int
+}
+
+func (hq *HierarchicalQuorum) Name() string {
+	return "hierarchical"
+}
+
+func (hq *HierarchicalQuorum) ContainsQuorum(acks map[string]bool) bool {
+	count := 0
+	groups := 0
+	for _, weights := range hq.Groups {
+		if totalWeight(weights) == 0 {
+			// A group of zero weight members does not take part in the quorum
+			continue
+		}
+		groups++
+		if containsWeightedMajority(weights, acks) {
+			count++
+		}
+	}
+	return count > groups/2
+}
+
+// quorumVerifier for the current voting members, using QUORUM, QUORUM_WEIGHTS and QUORUM_GROUPS of the ensemble
+func (ab *AtomicBroadcast) quorumVerifier(members []string) QuorumVerifier {
+	switch ab.Quorum {
+	case "weighted":
+		return &WeightedQuorum{Weights: ab.memberWeights(members)}
+	case "hierarchical":
+		weights := ab.memberWeights(members)
+		grouped := make(map[string]bool)
+
+		var groups []map[string]int
+		for _, group := range strings.Split(ab.QuorumGroups, "|") {
+			groupWeights := make(map[string]int)
+			for _, port := range splitPorts(group) {
+				if weight, ok := weights[port]; ok {
+					groupWeights[port] = weight
+					grouped[port] = true
+				}
+			}
+			if len(groupWeights) > 0 {
+				groups = append(groups, groupWeights)
+			}
+		}
+
+		// Members not listed in any group, e.g. added by Reconfig, form their own group
+		ungrouped := make(map[string]int)
+		for port, weight := range weights {
+			if !grouped[port] {
+				ungrouped[port] = weight
+			}
+		}
+		if len(ungrouped) > 0 {
+			groups = append(groups, ungrouped)
+		}
+		return &HierarchicalQuorum{Groups: groups}
+	default:
+		return &MajorityQuorum{Members: members}
+	}
+}
+
+// memberWeights from QUORUM_WEIGHTS, e.g. "8080:3,8081:1", members not listed have weight 1
+func (ab *AtomicBroadcast) memberWeights(members []string) map[string]int {
+	configured := make(map[string]int)
+	for _, entry := range splitPorts(ab.QuorumWeights) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			continue
+		}
+		configured[parts[0]] = weight
+	}
+
+	weights := make(map[string]int)
+	for _, port := range members {
+		weight, ok := configured[port]
+		if !ok {
+			weight = 1
+		}
+		weights[port] = weight
+	}
+	return weights
+}
+
+// loadQuorumConfig from environment variables
+func (ab *AtomicBroadcast) loadQuorumConfig() {
+	ab.Quorum = os.Getenv("QUORUM")
+	ab.QuorumWeights = os.Getenv("QUORUM_WEIGHTS")
+	ab.QuorumGroups = os.Getenv("QUORUM_GROUPS")
+}
+
+func containsWeightedMajority(weights map[string]int, acks map[string]bool) bool {
+	acked := 0
+	for port, weight := range weights {
+		if acks[port] {
+			acked += weight
+		}
+	}
+	return 2*acked > totalWeight(weights)
+}
+
+func totalWeight(weights map[string]int) int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	return total
+}
@@ -0,0 +1,107 @@
+package zab
+
+import (
+	"testing"
+)
+
+func acked(ports ...string) map[string]bool {
+	acks := make(map[string]bool)
+	for _, port := range ports {
+		acks[port] = true
+	}
+	return acks
+}
+
+func TestMajorityQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+		acks    map[string]bool
+		want    bool
+	}{
+		{"no member", nil, acked("8080"), false},
+		{"single member", []string{"8080"}, acked("8080"), true},
+		{"majority of three", []string{"8080", "8081", "8082"}, acked("8080", "8081"), true},
+		{"minority of three", []string{"8080", "8081", "8082"}, acked("8080"), false},
+		{"half of four", []string{"8080", "8081", "8082", "8083"}, acked("8080", "8081"), false},
+		{"majority of four", []string{"8080", "8081", "8082", "8083"}, acked("8080", "8081", "8083"), true},
+		{"ACK of a non-member", []string{"8080", "8081", "8082"}, acked("8080", "9090"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mq := &MajorityQuorum{Members: test.members}
+			if got := mq.ContainsQuorum(test.acks); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWeightedQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		acks    map[string]bool
+		want    bool
+	}{
+		{"heavy member alone", map[string]int{"8080": 3, "8081": 1, "8082": 1}, acked("8080"), true},
+		{"light members only", map[string]int{"8080": 3, "8081": 1, "8082": 1}, acked("8081", "8082"), false},
+		{"half of the weight", map[string]int{"8080": 2, "8081": 1, "8082": 1}, acked("8080"), false},
+		{"zero weight member ACKs", map[string]int{"8080": 1, "8081": 1, "8082": 0}, acked("8080", "8082"), false},
+		{"zero weight member missing", map[string]int{"8080": 1, "8081": 1, "8082": 0}, acked("8080", "8081"), true},
+		{"only zero weight members", map[string]int{"8080": 0, "8081": 0}, acked("8080", "8081"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wq := &WeightedQuorum{Weights: test.weights}
+			if got := wq.ContainsQuorum(test.acks); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHierarchicalQuorum(t *testing.T) {
+	groups := []map[string]int{
+		{"8080": 1, "8081": 1, "8082": 1},
+		{"8083": 1, "8084": 1, "8085": 1},
+		{"8086": 1, "8087": 1, "8088": 1},
+	}
+	tests := []struct {
+		name   string
+		groups []map[string]int
+		acks   map[string]bool
+		want   bool
+	}{
+		{"majority in two groups", groups, acked("8080", "8081", "8083", "8084"), true},
+		{"majority in one group", groups, acked("8080", "8081", "8082", "8083"), false},
+		{"minority in every group", groups, acked("8080", "8083", "8086"), false},
+		{"group lacking a majority", groups, acked("8080", "8081", "8083", "8086", "8087"), true},
+		{"half of the groups", groups[:2], acked("8080", "8081"), false},
+		{"zero weight group ignored", append([]map[string]int{{"9090": 0, "9091": 0}}, groups[:1]...),
+			acked("8080", "8081"), true},
+		{"zero weight member in group", []map[string]int{{"8080": 1, "8081": 0}, {"8082": 1, "8083": 1}},
+			acked("8081", "8082", "8083"), false},
+		{"only zero weight groups", []map[string]int{{"8080": 0}}, acked("8080"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hq := &HierarchicalQuorum{Groups: test.groups}
+			if got := hq.ContainsQuorum(test.acks); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuorumVerifierGroupsUngroupedMembers(t *testing.T) {
+	ab := &AtomicBroadcast{Quorum: "hierarchical", QuorumGroups: "8080,8081,8082|8083,8084,8085"}
+	qv := ab.quorumVerifier([]string{"8080", "8081", "8082", "8083", "8084", "8085", "8086"})
+	hq, ok := qv.(*HierarchicalQuorum)
+	if !ok || len(hq.Groups) != 3 {
+		t.Fatalf("got %+v", qv)
+	}
+	if !qv.ContainsQuorum(acked("8080", "8081", "8086")) {
+		t.Fatal("majority in the group of 8080 and the ungrouped 8086 is a quorum")
+	}
+}
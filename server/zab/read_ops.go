@@ -1,7 +1,14 @@
 package zab
 
 import (
+	"encoding/json"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"github.com/tnbl265/zooweeper/ztree"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // ReadOps for Read Request
@@ -9,8 +16,283 @@ type ReadOps struct {
 	ab *AtomicBroadcast
 }
 
-// GetAllMetadata returns all ZNode from the ZTree as a list of Metadata
+// ReadConsistency of a Read Request, from the "consistency" query parameter or X-Read-Consistency header
+type ReadConsistency string
+
+const (
+	// LOCAL reads whatever this server has applied, the default
+	LOCAL ReadConsistency = "local"
+	// SYNC catches up with the Leader before reading locally
+	SYNC ReadConsistency = "sync"
+	// LINEARIZABLE reads from the Leader while it holds a lease from a quorum
+	LINEARIZABLE ReadConsistency = "linearizable"
+)
+
+// GetAllMetadata returns all ZNode from the ZTree as a list of Metadata, marked as possibly stale in read-only mode
 func (ro *ReadOps) GetAllMetadata(w http.ResponseWriter, r *http.Request) {
-	results, _ := ro.ab.ZTree.AllMetadata()
+	if !ro.waitForMinZxid(w, r) {
+		return
+	}
+
+	switch readConsistency(r) {
+	case SYNC:
+		if _, err := ro.ab.syncWithLeader(); err != nil {
+			ro.ab.WriteError(w, err)
+			return
+		}
+	case LINEARIZABLE:
+		local, _ := ro.ab.ZTree.GetLocalState()
+		if local.NodePort != local.Leader {
+			ro.forwardToLeader(w, r)
+			return
+		}
+		if !ro.ab.HasLeaderLease() {
+			ro.ab.WriteError(w, ErrLeaseExpired)
+			return
+		}
+	}
+
+	var results []*ztree.Metadata
+	if asOfZxid, ok := ro.asOfZxid(w, r); !ok {
+		return
+	} else if asOfZxid > 0 {
+		w.Header().Set("X-As-Of-Zxid", strconv.Itoa(asOfZxid))
+		results, _ = ro.ab.ZTree.AllMetadataAsOf(asOfZxid)
+	} else {
+		results, _ = ro.ab.ZTree.AllMetadata()
+	}
+	if ro.ab.ReadOnly() {
+		w.Header().Set("X-ZooWeeper-Stale", "true")
+	}
 	ro.ab.writeJSON(w, http.StatusOK, results)
 }
+
+// asOfZxid of a point-in-time Read Request, from the asOfZxid or asOfTime query parameter, zero for the current ZTree.
+// Reading before the PurgedZxid is refused as the versions active then may be gone.
+func (ro *ReadOps) asOfZxid(w http.ResponseWriter, r *http.Request) (int, bool) {
+	var asOfZxid int
+	if asOfZxidStr := r.URL.Query().Get("asOfZxid"); asOfZxidStr != "" {
+		zxid, err := strconv.Atoi(asOfZxidStr)
+		if err != nil || zxid <= 0 {
+			ro.ab.WriteError(w, ErrInvalidAsOf)
+			return 0, false
+		}
+		// A zxid this server did not apply yet is waited for, as with X-Min-Zxid
+		if !ro.catchUpTo(w, r, zxid) {
+			return 0, false
+		}
+		asOfZxid = zxid
+	} else if asOfTimeStr := r.URL.Query().Get("asOfTime"); asOfTimeStr != "" {
+		asOfTime, err := time.Parse(time.RFC3339Nano, asOfTimeStr)
+		if err != nil {
+			ro.ab.WriteError(w, ErrInvalidAsOf)
+			return 0, false
+		}
+		asOfZxid, _ = ro.ab.ZTree.GetZNodeIdAsOfTime(asOfTime)
+	} else {
+		return 0, true
+	}
+
+	purgedZxid, _ := ro.ab.ZTree.GetPurgedZxid()
+	if asOfZxid <= purgedZxid {
+		ro.ab.WriteError(w, ErrHistoryPurged)
+		return 0, false
+	}
+	return asOfZxid, true
+}
+
+// GetHistory of the process ZNode of a client given as senderIp query parameter, every version with its zxid,
+// Timestamp and the ZooWeeper server it was written through
+func (ro *ReadOps) GetHistory(w http.ResponseWriter, r *http.Request) {
+	senderIp := r.URL.Query().Get("senderIp")
+	history, err := ro.ab.ZTree.GetHistory(senderIp)
+	if err != nil {
+		ro.ab.WriteError(w, err)
+		return
+	}
+	if len(history) == 0 {
+		ro.ab.WriteError(w, ErrNoNode)
+		return
+	}
+
+	purgedZxid, _ := ro.ab.ZTree.GetPurgedZxid()
+	result := data.ZNodeHistory{
+		SenderIp:   senderIp,
+		PurgedZxid: purgedZxid,
+	}
+	for _, metadata := range history {
+		result.Versions = append(result.Versions, data.ZNodeVersion{
+			Version:   metadata.Version,
+			Zxid:      metadata.NodeId,
+			Timestamp: metadata.Timestamp,
+			Writer:    metadata.ReceiverIp,
+			Clients:   metadata.Clients,
+		})
+	}
+	_ = ro.ab.writeJSON(w, http.StatusOK, result)
+}
+
+// GetConfig of the ensemble as the read-only virtual ZNode /zookeeper/config, from the LocalState of this server
+// (Ref: https://zookeeper.apache.org/doc/current/zookeeperReconfig.html#sc_reconfig_retrieving)
+func (ro *ReadOps) GetConfig(w http.ResponseWriter, r *http.Request) {
+	local, err := ro.ab.ZTree.GetLocalState()
+	if err != nil {
+		ro.ab.WriteError(w, err)
+		return
+	}
+
+	view := data.EnsembleView{
+		Epoch:  ro.ab.Epoch(),
+		Leader: local.Leader,
+	}
+	for _, id := range splitPorts(local.Servers) {
+		role := PARTICIPANT
+		if ro.ab.IsObserver(id) {
+			role = OBSERVER
+		}
+		view.Members = append(view.Members, data.MemberView{
+			Id:        id,
+			Role:      role,
+			ClientURL: ro.ab.clientURL(id),
+			PeerURL:   ro.ab.peerURL(id),
+		})
+	}
+	_ = ro.ab.writeJSON(w, http.StatusOK, view)
+}
+
+// Sync handler for a client to make sure this server applied everything the Leader committed, similar to
+// ZooKeeper sync(path) the whole ZTree is synced whatever the path
+func (ro *ReadOps) Sync(w http.ResponseWriter, r *http.Request) {
+	zxid, err := ro.ab.syncWithLeader()
+	if err != nil {
+		ro.ab.WriteError(w, err)
+		return
+	}
+
+	payload := JSONResponse{
+		Message: "Synced " + r.URL.Query().Get("path"),
+		Data:    data.ZxidResult{Zxid: zxid},
+	}
+	_ = ro.ab.writeJSON(w, http.StatusOK, payload)
+}
+
+// waitForMinZxid of a Read Request (X-Min-Zxid header or minZxid query parameter) for read-your-writes, redirecting to
+// the Leader if this server does not catch up within SyncTimeout
+func (ro *ReadOps) waitForMinZxid(w http.ResponseWriter, r *http.Request) bool {
+	minZxidStr := r.URL.Query().Get("minZxid")
+	if minZxidStr == "" {
+		minZxidStr = r.Header.Get("X-Min-Zxid")
+	}
+	minZxid, err := strconv.Atoi(minZxidStr)
+	if err != nil {
+		return true
+	}
+	return ro.catchUpTo(w, r, minZxid)
+}
+
+// catchUpTo a zxid before reading, redirecting to the Leader if this server does not catch up within SyncTimeout
+func (ro *ReadOps) catchUpTo(w http.ResponseWriter, r *http.Request, minZxid int) bool {
+	highestZNodeId, _ := ro.ab.ZTree.GetHighestZNodeId()
+	if highestZNodeId >= minZxid {
+		return true
+	}
+
+	// A Follower pulls from the Leader, which already waits up to SyncTimeout
+	local, _ := ro.ab.ZTree.GetLocalState()
+	timeout := ro.ab.SyncTimeout
+	if local.NodePort != local.Leader {
+		ro.ab.syncWithLeader()
+		timeout = 0
+	}
+	if ro.ab.waitForZxid(minZxid, timeout) {
+		return true
+	}
+
+	if local.NodePort == local.Leader || local.Leader == "" {
+		ro.ab.WriteError(w, ErrSyncTimeout)
+		return false
+	}
+	color.Yellow("%s behind zxid %d, redirecting to Leader %s", local.NodePort, minZxid, local.Leader)
+	http.Redirect(w, r, ro.ab.clientURL(local.Leader)+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return false
+}
+
+func (ro *ReadOps) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	resp, err := ro.ab.ForwardRequestToLeader(r)
+	if err != nil {
+		ro.ab.WriteError(w, ErrNoLeader)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// syncWithLeader pulls any Metadata this server is missing from the Leader, returning the Leader's highest ZNodeId
+func (ab *AtomicBroadcast) syncWithLeader() (int, error) {
+	local, _ := ab.ZTree.GetLocalState()
+	highestZNodeId, _ := ab.ZTree.GetHighestZNodeId()
+	if local.NodePort == local.Leader {
+		return highestZNodeId, nil
+	}
+	if local.Leader == "" {
+		return 0, ErrNoLeader
+	}
+
+	url := ab.peerURL(local.Leader) + "/lastZxid"
+	resp, err := ab.sendRequest(url, "POST", nil)
+	if err != nil {
+		return 0, ErrNoLeader
+	}
+	var leaderMetadata ztree.Metadata
+	err = json.NewDecoder(resp.Body).Decode(&leaderMetadata)
+	resp.Body.Close()
+	if err != nil {
+		return 0, ErrNoLeader
+	}
+
+	if highestZNodeId < leaderMetadata.NodeId {
+		color.Yellow("%s syncing from %d to Leader %s at %d", local.NodePort, highestZNodeId, local.Leader, leaderMetadata.NodeId)
+		jsonData, _ := json.Marshal(ztree.Metadata{NodeId: highestZNodeId})
+		url := ab.peerURL(local.Leader) + "/requestMetadata"
+		_, err := ab.sendRequest(url, "POST", jsonData)
+		if err != nil {
+			return 0, ErrNoLeader
+		}
+	}
+
+	if !ab.waitForZxid(leaderMetadata.NodeId, ab.SyncTimeout) {
+		return 0, ErrSyncTimeout
+	}
+	return leaderMetadata.NodeId, nil
+}
+
+// waitForZxid until this server applied at least the given ZNodeId, or the timeout passed
+func (ab *AtomicBroadcast) waitForZxid(zxid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		highestZNodeId, _ := ab.ZTree.GetHighestZNodeId()
+		if highestZNodeId >= zxid {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func readConsistency(r *http.Request) ReadConsistency {
+	consistency := r.URL.Query().Get("consistency")
+	if consistency == "" {
+		consistency = r.Header.Get("X-Read-Consistency")
+	}
+	switch ReadConsistency(consistency) {
+	case SYNC, LINEARIZABLE:
+		return ReadConsistency(consistency)
+	default:
+		return LOCAL
+	}
+}
@@ -0,0 +1,102 @@
+package zab
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ElectionState persisted per server so a restart neither goes back to an older epoch nor votes twice in a round
+// (Ref: currentEpoch and acceptedEpoch in https://zookeeper.apache.org/doc/current/zookeeperInternals.html)
+type ElectionState struct {
+	// CurrentEpoch of the Leader this server follows, proposals from a lower epoch are rejected
+	CurrentEpoch int `json:"currentEpoch"`
+	// AcceptedEpoch is the highest epoch this server was told of, a new Leader must use a higher one
+	AcceptedEpoch int       `json:"acceptedEpoch"`
+	ElectionRound int       `json:"electionRound"`
+	Vote          data.Vote `json:"vote"`
+}
+
+// statePath next to the ZTree database, e.g. ztree/zooweeper-metadata-0.state.json
+func statePath(dbPath string) string {
+	return strings.TrimSuffix(dbPath, filepath.Ext(dbPath)) + ".state.json"
+}
+
+// loadElectionState from disk, a missing file is a fresh server. An unreadable or corrupted one is an error, starting
+// from epoch 0 could vote twice in a round or follow a stale Leader
+func (ab *AtomicBroadcast) loadElectionState() error {
+	content, err := os.ReadFile(ab.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read election state %s: %w", ab.StatePath, err)
+	}
+
+	var state ElectionState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("corrupted election state %s: %w", ab.StatePath, err)
+	}
+	ab.epoch = state.CurrentEpoch
+	ab.acceptedEpoch = state.AcceptedEpoch
+	ab.electionRound = state.ElectionRound
+	ab.vote = state.Vote
+	color.Cyan("Loaded election state with epoch %d, accepted epoch %d, round %d", ab.epoch, ab.acceptedEpoch, ab.electionRound)
+	return nil
+}
+
+// persistElectionState with a write to a temporary file, fsync then rename, so a crash leaves either the old or the
+// new state but never a partial one. Callers hold electionMu and undo their change on error.
+func (ab *AtomicBroadcast) persistElectionState() error {
+	if ab.StatePath == "" {
+		return nil
+	}
+	state := ElectionState{
+		CurrentEpoch:  ab.epoch,
+		AcceptedEpoch: ab.acceptedEpoch,
+		ElectionRound: ab.electionRound,
+		Vote:          ab.vote,
+	}
+	content, _ := json.Marshal(state)
+
+	if err := writeFileAtomic(ab.StatePath, content); err != nil {
+		color.Red("Failed to persist election state %s: %s", ab.StatePath, err)
+		return err
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
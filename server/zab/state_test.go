@@ -0,0 +1,68 @@
+package zab
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tnbl265/zooweeper/request_processors/data"
+)
+
+func TestElectionStatePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zooweeper-metadata-0.state.json")
+	ab := &AtomicBroadcast{StatePath: path}
+	if err := ab.SetEpoch(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ab.SetElectionVote(2, data.Vote{Epoch: 3, Zxid: 7, ServerId: "8082"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &AtomicBroadcast{StatePath: path}
+	if err := restarted.loadElectionState(); err != nil {
+		t.Fatal(err)
+	}
+	round, vote := restarted.ElectionVote()
+	if restarted.Epoch() != 3 || restarted.AcceptedEpoch() != 3 || round != 2 || vote.ServerId != "8082" {
+		t.Fatalf("loaded epoch %d, accepted epoch %d, round %d, vote %+v", restarted.Epoch(), restarted.AcceptedEpoch(), round, vote)
+	}
+}
+
+func TestElectionStateUnchangedOnWriteError(t *testing.T) {
+	dir := t.TempDir()
+	ab := &AtomicBroadcast{StatePath: filepath.Join(dir, "zooweeper-metadata-0.state.json")}
+	if err := ab.SetEpoch(3); err != nil {
+		t.Fatal(err)
+	}
+	// Writes now fail, the state file can no longer be replaced
+	os.RemoveAll(dir)
+
+	if err := ab.SetEpoch(4); err == nil || ab.Epoch() != 3 || ab.AcceptedEpoch() != 3 {
+		t.Fatalf("got %v with epoch %d, accepted epoch %d", err, ab.Epoch(), ab.AcceptedEpoch())
+	}
+	if accepted, err := ab.acceptEpoch(5); accepted || err == nil || ab.AcceptedEpoch() != 3 {
+		t.Fatalf("got %v, %v with accepted epoch %d", accepted, err, ab.AcceptedEpoch())
+	}
+	if err := ab.SetElectionVote(1, data.Vote{ServerId: "8080"}); err == nil {
+		t.Fatal("vote recorded without persisting it")
+	}
+	if round, vote := ab.ElectionVote(); round != 0 || vote.ServerId != "" {
+		t.Fatalf("round %d, vote %+v", round, vote)
+	}
+}
+
+func TestElectionStateCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	ab := &AtomicBroadcast{StatePath: filepath.Join(dir, "zooweeper-metadata-0.state.json")}
+	if err := ab.loadElectionState(); err != nil {
+		t.Fatalf("fresh server: %v", err)
+	}
+
+	os.WriteFile(ab.StatePath, []byte(`{"currentEpoch":3,`), 0644)
+	if err := ab.loadElectionState(); err == nil {
+		t.Fatal("loaded a corrupted election state")
+	}
+	if ab.Epoch() != 0 {
+		t.Fatalf("epoch %d", ab.Epoch())
+	}
+}
@@ -2,7 +2,6 @@ package zab
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/fatih/color"
 	"github.com/tnbl265/zooweeper/ztree"
 	"log"
@@ -18,7 +17,7 @@ type SyncOps struct {
 
 // SyncRequestHandler handler for ZooWeeper server to send back current highest ZNodeId
 func (so *SyncOps) SyncRequestHandler(_ http.ResponseWriter, r *http.Request) {
-	zNode, _ := so.ab.ZTree.GetLocalMetadata()
+	local, _ := so.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
 
 	highestZNodeId, _ := so.ab.ZTree.GetHighestZNodeId()
@@ -27,73 +26,75 @@ func (so *SyncOps) SyncRequestHandler(_ http.ResponseWriter, r *http.Request) {
 	}
 	jsonData, _ := json.Marshal(metadata)
 
-	color.Yellow("%s received SyncRequest from %s", zNode.NodePort, clientPort)
-	color.Yellow("%s sending syncACK with highest ZNodeId %d to %s\n", zNode.NodePort, highestZNodeId, clientPort)
-	url := fmt.Sprintf(so.ab.BaseURL + ":" + clientPort + "/syncResponse")
+	color.Yellow("%s received SyncRequest from %s", local.NodePort, clientPort)
+	color.Yellow("%s sending syncACK with highest ZNodeId %d to %s\n", local.NodePort, highestZNodeId, clientPort)
+	url := so.ab.peerURL(clientPort) + "/syncResponse"
 	_, err = so.ab.sendRequest(url, "POST", jsonData)
 }
 
-// SyncResponseHandler handler for ZooWeeper server to wait for majority value of highest ZNodeId and send back current highestZNodeId
+// SyncResponseHandler handler for ZooWeeper server to wait for a quorum value of highest ZNodeId and send back current highestZNodeId
 func (so *SyncOps) SyncResponseHandler(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := so.ab.ZTree.GetLocalMetadata()
+	local, _ := so.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
 
 	var requestPayload ztree.Metadata
 	so.ab.readJSON(w, r, &requestPayload)
 
-	color.Yellow("%s received SyncResponse with highestZNodeId %d from %s", zNode.NodePort, requestPayload.NodeId, clientPort)
+	color.Yellow("%s received SyncResponse with highestZNodeId %d from %s", local.NodePort, requestPayload.NodeId, clientPort)
 
-	// Wait for majority of Follower to ACK
-	portsSlice := strings.Split(zNode.Servers, ",")
-	majority := len(portsSlice) / 2
+	if so.ab.IsObserver(clientPort) {
+		return
+	}
+
+	// Wait for a quorum of Follower to ACK
+	portsSlice := so.ab.votingMembers(strings.Split(local.Servers, ","))
+	verifier := so.ab.quorumVerifier(portsSlice)
 
 	if so.ab.SyncState() != ACKED {
+		acks := so.ab.AddSyncAck(clientPort)
 		for {
-			currentSyncAckCount := so.ab.SyncCounter()
-			currentSyncAckCount++
-			so.ab.SetSyncCounter(currentSyncAckCount)
-
-			if currentSyncAckCount > majority {
-				color.Yellow("Leader %s received majority syncAck, %d\n", zNode.NodePort, currentSyncAckCount)
-				so.ab.SetSyncCounter(0)
+			if verifier.ContainsQuorum(acks) {
+				color.Yellow("Leader %s received %s quorum syncAck, %d\n", local.NodePort, verifier.Name(), len(acks))
 				so.ab.SetSyncState(ACKED)
 				break
 			} else if so.ab.SyncState() == ACKED {
 				break
 			}
 			time.Sleep(100 * time.Millisecond)
+			acks = so.ab.SyncAcks()
 		}
 	}
 }
 
 // RequestMetadataHandler handler for ZooWeeper server to send the requested Metadata based on highestZNodeId
 func (so *SyncOps) RequestMetadataHandler(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := so.ab.ZTree.GetLocalMetadata()
+	local, _ := so.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
 
 	var requestPayload ztree.Metadata
 	so.ab.readJSON(w, r, &requestPayload)
 
 	highestZNodeId := requestPayload.NodeId
-	color.Yellow("%s received RequestMetadata with highestZNodeId %d from %s", zNode.NodePort, highestZNodeId, clientPort)
+	color.Yellow("%s received RequestMetadata with highestZNodeId %d from %s", local.NodePort, highestZNodeId, clientPort)
 
-	metadatas, _ := so.ab.ZTree.GetMetadatasGreaterThanZNodeId(highestZNodeId)
-	jsonData, _ := json.Marshal(metadatas)
-
-	color.Yellow("%s send requested Metadata to %s\n", zNode.NodePort, clientPort)
-	url := so.ab.BaseURL + ":" + clientPort + "/updateMetadata"
-	so.ab.sendRequest(url, "POST", jsonData)
+	color.Yellow("%s send requested Metadata to %s\n", local.NodePort, clientPort)
+	so.ab.sendMissingMetadata(clientPort, highestZNodeId)
 }
 
 // UpdateMetadataHandler handler for ZooWeeper server to update Metadata based on requested Metadata
 func (so *SyncOps) UpdateMetadataHandler(w http.ResponseWriter, r *http.Request) {
-	zNode, _ := so.ab.ZTree.GetLocalMetadata()
+	local, _ := so.ab.ZTree.GetLocalState()
 	clientPort := r.Header.Get("X-Sender-Port")
 
 	var metadatas ztree.Metadatas
-	so.ab.readJSON(w, r, &metadatas)
+	err := so.ab.readJSONLimit(w, r, &metadatas, so.ab.SyncMaxBytes)
+	if err != nil {
+		color.Red("%s failed to read updated Metadata from %s: %s", local.NodePort, clientPort, err)
+		_ = so.ab.writeJSON(w, http.StatusBadRequest, JSONResponse{Error: true, Message: err.Error()})
+		return
+	}
 
-	color.Yellow("%s received updated Metadata from %s", zNode.NodePort, clientPort)
+	color.Yellow("%s received updated Metadata from %s", local.NodePort, clientPort)
 
 	for _, metadata := range metadatas.MetadataList {
 		exists, err := so.ab.ZTree.ZNodeIdExists(metadata.NodeId)
@@ -110,5 +111,17 @@ func (so *SyncOps) UpdateMetadataHandler(w http.ResponseWriter, r *http.Request)
 			color.Yellow("Inserted Metadata for NodeId %d", metadata.NodeId)
 		}
 	}
+	so.ab.mergeRequestLog(metadatas.RequestLog)
+	if metadatas.Digest != nil && clientPort == local.Leader {
+		so.ab.catchUpPurged(metadatas.Digest.PurgedDigest, metadatas.PurgedZxid, metadatas.Retained)
+		// A ZNode this server already had may hold a different content than the one of the Leader
+		so.ab.compareDigest(clientPort, metadatas.Digest.Zxid, metadatas.Digest.Digest)
+	}
 	_ = so.ab.writeJSON(w, http.StatusOK, "Updated Metadata")
 }
+
+// LastZxidHandler handler for the Leader to reply with its last committed ZNodeId, used by sync
+func (so *SyncOps) LastZxidHandler(w http.ResponseWriter, _ *http.Request) {
+	highestZNodeId, _ := so.ab.ZTree.GetHighestZNodeId()
+	_ = so.ab.writeJSON(w, http.StatusOK, ztree.Metadata{NodeId: highestZNodeId})
+}
@@ -13,18 +13,68 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func (ab *AtomicBroadcast) AckCounter() int {
+// AddAck from a voting member and return all ACKs of the current proposal so far, false if the ACK is for another
+// proposal
+func (ab *AtomicBroadcast) AddAck(proposalId int, port string) (map[string]bool, bool) {
 	ab.proposalMu.Lock()
 	defer ab.proposalMu.Unlock()
-	return ab.ackCounter
+	if proposalId != ab.proposalId {
+		return nil, false
+	}
+	ab.acks[port] = true
+	return copyAcks(ab.acks), true
+}
+
+// addCommit of a server that committed the current proposal and return all servers that did so far, false if it is
+// for another proposal. An empty port only reads them.
+func (ab *AtomicBroadcast) addCommit(proposalId int, port string) (map[string]bool, bool) {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if proposalId != ab.proposalId {
+		return nil, false
+	}
+	if port != "" {
+		ab.commits[port] = true
+	}
+	return copyAcks(ab.commits), true
 }
 
-func (ab *AtomicBroadcast) SetAckCounter(ackCounter int) {
+func (ab *AtomicBroadcast) Acks() map[string]bool {
 	ab.proposalMu.Lock()
 	defer ab.proposalMu.Unlock()
-	ab.ackCounter = ackCounter
+	return copyAcks(ab.acks)
+}
+
+// newProposal with its id for the Followers to echo in their ACK, the Leader always ACKs its own proposal. Refused with
+// ErrLeaderTransfer once a leadership transfer started, checked under the same lock so none starts behind its back
+func (ab *AtomicBroadcast) newProposal(leader string) (int, error) {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if ab.transferring {
+		return 0, ErrLeaderTransfer
+	}
+	if ab.committedId > ab.proposalId {
+		// Committed as a Follower of another Leader, never reuse its proposal id
+		ab.proposalId = ab.committedId
+	}
+	ab.proposalId++
+	ab.acks = map[string]bool{leader: true}
+	ab.commits = make(map[string]bool)
+	ab.proposalState = PROPOSED
+	color.HiRed("Set ProposalState to %s\n", PROPOSED)
+	return ab.proposalId, nil
+}
+
+// isCurrentProposal or a late message of an earlier one
+func (ab *AtomicBroadcast) isCurrentProposal(proposalId int) bool {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	return proposalId == ab.proposalId
 }
 
 func (ab *AtomicBroadcast) ProposalState() ProposalState {
@@ -40,16 +90,114 @@ func (ab *AtomicBroadcast) SetProposalState(proposalState ProposalState) {
 	color.HiRed("Set ProposalState to %s\n", proposalState)
 }
 
-func (ab *AtomicBroadcast) SyncCounter() int {
+// commitProposal once committed locally at zxid
+func (ab *AtomicBroadcast) commitProposal(proposalId int, zxid int) {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	ab.proposalState = COMMITTED
+	if proposalId > ab.committedId {
+		ab.committedId = proposalId
+		ab.committedZxid = zxid
+	}
+	color.HiRed("Set ProposalState to %s\n", COMMITTED)
+}
+
+// committedAt zxid if the proposal is the last one committed locally
+func (ab *AtomicBroadcast) committedAt(proposalId int) (int, bool) {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if proposalId == 0 || proposalId != ab.committedId {
+		return 0, false
+	}
+	return ab.committedZxid, true
+}
+
+// proposalOutcome once the Leader either committed the proposal locally or aborted it, decided is false meanwhile
+func (ab *AtomicBroadcast) proposalOutcome(proposalId int) (committed bool, decided bool) {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if proposalId <= ab.committedId {
+		return true, true
+	}
+	if proposalId != ab.proposalId || ab.proposalState == ABORTED {
+		return false, true
+	}
+	return false, false
+}
+
+func (ab *AtomicBroadcast) AddSyncAck(port string) map[string]bool {
 	ab.syncMu.Lock()
 	defer ab.syncMu.Unlock()
-	return ab.syncCounter
+	ab.syncAcks[port] = true
+	return copyAcks(ab.syncAcks)
 }
 
-func (ab *AtomicBroadcast) SetSyncCounter(syncCounter int) {
+// ProposalIdle once the last proposal is either committed or aborted
+func (ab *AtomicBroadcast) ProposalIdle() bool {
+	state := ab.ProposalState()
+	return state == COMMITTED || state == ABORTED
+}
+
+// startTransfer unless another leadership transfer is running
+func (ab *AtomicBroadcast) startTransfer() bool {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if ab.transferring {
+		return false
+	}
+	ab.transferring = true
+	return true
+}
+
+func (ab *AtomicBroadcast) endTransfer() {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	ab.transferring = false
+}
+
+// acknowledgeProposal once a quorum ACKed, unless the proposal was aborted in the meantime
+func (ab *AtomicBroadcast) acknowledgeProposal() bool {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if ab.proposalState != PROPOSED {
+		return ab.proposalState == ACKNOWLEDGED
+	}
+	ab.proposalState = ACKNOWLEDGED
+	color.HiRed("Set ProposalState to %s\n", ACKNOWLEDGED)
+	return true
+}
+
+// abortProposal once its deadline passed, unless a quorum ACKed in the meantime
+func (ab *AtomicBroadcast) abortProposal() bool {
+	ab.proposalMu.Lock()
+	defer ab.proposalMu.Unlock()
+	if ab.proposalState != PROPOSED {
+		return false
+	}
+	ab.proposalState = ABORTED
+	ab.acks = make(map[string]bool)
+	color.HiRed("Set ProposalState to %s\n", ABORTED)
+	return true
+}
+
+func (ab *AtomicBroadcast) SyncAcks() map[string]bool {
 	ab.syncMu.Lock()
 	defer ab.syncMu.Unlock()
-	ab.syncCounter = syncCounter
+	return copyAcks(ab.syncAcks)
+}
+
+func (ab *AtomicBroadcast) ResetSyncAcks(port string) {
+	ab.syncMu.Lock()
+	defer ab.syncMu.Unlock()
+	ab.syncAcks = map[string]bool{port: true}
+}
+
+func copyAcks(acks map[string]bool) map[string]bool {
+	result := make(map[string]bool, len(acks))
+	for port, acked := range acks {
+		result[port] = acked
+	}
+	return result
 }
 
 func (ab *AtomicBroadcast) SyncState() SyncState {
@@ -65,8 +213,221 @@ func (ab *AtomicBroadcast) SetSyncState(syncState SyncState) {
 	color.HiRed("Set SyncState to %s\n", syncState)
 }
 
+func (ab *AtomicBroadcast) Epoch() int {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	return ab.epoch
+}
+
+// SetEpoch once this server follows or leads a Leader of that epoch, unchanged unless persisted
+func (ab *AtomicBroadcast) SetEpoch(epoch int) error {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	previousEpoch, previousAccepted := ab.epoch, ab.acceptedEpoch
+	ab.epoch = epoch
+	if epoch > ab.acceptedEpoch {
+		ab.acceptedEpoch = epoch
+	}
+	if err := ab.persistElectionState(); err != nil {
+		ab.epoch, ab.acceptedEpoch = previousEpoch, previousAccepted
+		return err
+	}
+	color.HiRed("Set Epoch to %d\n", epoch)
+	return nil
+}
+
+func (ab *AtomicBroadcast) AcceptedEpoch() int {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	return ab.acceptedEpoch
+}
+
+// acceptEpoch proposed by a new Leader, returns false if this server already accepted a higher one or could not
+// persist it
+func (ab *AtomicBroadcast) acceptEpoch(epoch int) (bool, error) {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	if epoch < ab.acceptedEpoch {
+		return false, nil
+	}
+	previousAccepted := ab.acceptedEpoch
+	ab.acceptedEpoch = epoch
+	if err := ab.persistElectionState(); err != nil {
+		ab.acceptedEpoch = previousAccepted
+		return false, err
+	}
+	return true, nil
+}
+
+// nextEpoch for a new Leader, higher than any epoch this server accepted
+func (ab *AtomicBroadcast) nextEpoch(epoch int) int {
+	if accepted := ab.AcceptedEpoch(); accepted > epoch {
+		epoch = accepted
+	}
+	return epoch + 1
+}
+
+func (ab *AtomicBroadcast) ElectionVote() (int, data.Vote) {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	return ab.electionRound, ab.vote
+}
+
+// SetElectionVote of a round, unchanged unless persisted so this server never votes twice in a round
+func (ab *AtomicBroadcast) SetElectionVote(round int, vote data.Vote) error {
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	previousRound, previousVote := ab.electionRound, ab.vote
+	ab.electionRound = round
+	ab.vote = vote
+	if err := ab.persistElectionState(); err != nil {
+		ab.electionRound, ab.vote = previousRound, previousVote
+		return err
+	}
+	return nil
+}
+
+// nextElectionRound starts a new Fast Leader Election round with a vote for itself
+func (ab *AtomicBroadcast) nextElectionRound() (int, error) {
+	credentials := ab.credentials()
+
+	ab.electionMu.Lock()
+	defer ab.electionMu.Unlock()
+	previousVote := ab.vote
+	ab.electionRound++
+	ab.vote = credentials
+	if err := ab.persistElectionState(); err != nil {
+		ab.electionRound--
+		ab.vote = previousVote
+		return 0, err
+	}
+	return ab.electionRound, nil
+}
+
+// credentials of the current server for Fast Leader Election, using highest ZNodeId as last zxid
+func (ab *AtomicBroadcast) credentials() data.Vote {
+	local, _ := ab.ZTree.GetLocalState()
+	highestZNodeId, _ := ab.ZTree.GetHighestZNodeId()
+	return data.Vote{
+		Epoch:    ab.Epoch(),
+		Zxid:     highestZNodeId,
+		ServerId: local.NodePort,
+	}
+}
+
+func (ab *AtomicBroadcast) ReadOnly() bool {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	return ab.readOnly
+}
+
+func (ab *AtomicBroadcast) SetReadOnly(readOnly bool) {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	ab.readOnly = readOnly
+}
+
+// recordContact with another server, from a Heartbeat in either direction
+func (ab *AtomicBroadcast) recordContact(port string) {
+	if port == "" {
+		return
+	}
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	ab.lastContact[port] = time.Now()
+}
+
+// recordHeartbeat from the Leader or a HeartbeatAck from a Follower, learnt by the PhiAccrualDetector of that server
+func (ab *AtomicBroadcast) recordHeartbeat(port string) {
+	ab.recordContact(port)
+	ab.detector(port).Heartbeat(time.Now())
+}
+
+func (ab *AtomicBroadcast) detector(port string) *PhiAccrualDetector {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	detector, ok := ab.detectors[port]
+	if !ok {
+		// Regular heartbeats still get some tolerance, a quarter tick of jitter
+		detector = NewPhiAccrualDetector(ab.TickTime / 4)
+		ab.detectors[port] = detector
+	}
+	return detector
+}
+
+// resetDetector of a server, e.g. a new Leader whose heartbeats have not been learnt yet
+func (ab *AtomicBroadcast) resetDetector(port string) {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	delete(ab.detectors, port)
+}
+
+func (ab *AtomicBroadcast) recordFollowerZxid(port string, zxid int, diverged bool) {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	ab.followerZxid[port] = zxid
+	ab.followerDiverged[port] = diverged
+}
+
+// LastLeaderHeartbeat received by this Follower and when it arrived
+func (ab *AtomicBroadcast) LastLeaderHeartbeat() (data.Heartbeat, time.Time) {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	return ab.leaderHeartbeat, ab.heartbeatAt
+}
+
+func (ab *AtomicBroadcast) setLeaderHeartbeat(heartbeat data.Heartbeat) {
+	ab.healthMu.Lock()
+	defer ab.healthMu.Unlock()
+	ab.leaderHeartbeat = heartbeat
+	ab.heartbeatAt = time.Now()
+}
+
+func (ab *AtomicBroadcast) IsObserver(port string) bool {
+	ab.configMu.Lock()
+	defer ab.configMu.Unlock()
+	return ab.observers[port]
+}
+
+func (ab *AtomicBroadcast) Observers() []string {
+	ab.configMu.Lock()
+	defer ab.configMu.Unlock()
+	return sortedPorts(ab.observers)
+}
+
+func (ab *AtomicBroadcast) SetObservers(observers []string) {
+	ab.configMu.Lock()
+	defer ab.configMu.Unlock()
+	ab.observers = make(map[string]bool)
+	for _, port := range observers {
+		if port != "" {
+			ab.observers[port] = true
+		}
+	}
+}
+
+// votingMembers filters out Observers, which never ACK proposals nor stand for election
+func (ab *AtomicBroadcast) votingMembers(servers []string) []string {
+	var voting []string
+	for _, port := range servers {
+		if !ab.IsObserver(port) {
+			voting = append(voting, port)
+		}
+	}
+	return voting
+}
+
+func (ab *AtomicBroadcast) electionStrategy(name string) ElectionStrategy {
+	switch name {
+	case "fast":
+		return &FastLeaderElection{ab: ab}
+	default:
+		return &BullyElection{ab: ab}
+	}
+}
+
 // NewAtomicBroadcast self-reference to parent - ref: https://stackoverflow.com/questions/27918208/go-get-parent-struct
-func NewAtomicBroadcast(dbPath string) *AtomicBroadcast {
+func NewAtomicBroadcast(dbPath, storageEngine string) *AtomicBroadcast {
 	ab := &AtomicBroadcast{}
 	baseURL := os.Getenv("BASE_URL")
 	if baseURL == "" {
@@ -74,20 +435,100 @@ func NewAtomicBroadcast(dbPath string) *AtomicBroadcast {
 	}
 	ab.BaseURL = baseURL
 
-	// Connect to the Database
-	log.Println("Connecting to", dbPath)
-	db, err := ab.OpenDB(dbPath)
-	if err != nil {
+	// Connect to the Database, or the transaction log of the txnlog storage engine
+	if storageEngine == "" {
+		storageEngine = os.Getenv("STORAGE_ENGINE")
+	}
+	switch storageEngine {
+	case "memory":
+		log.Println("Keeping the ZTree in memory only")
+		ab.ZTree = ztree.NewMemoryTree()
+	case "txnlog":
+		snapshotCount := 10000
+		if count, err := strconv.Atoi(os.Getenv("SNAPSHOT_COUNT")); err == nil && count > 0 {
+			snapshotCount = count
+		}
+		ab.ZTree = ztree.NewTxnLogTree(strings.TrimSuffix(dbPath, ".db")+".txnlog", snapshotCount)
+	case "", "sqlite":
+		log.Println("Connecting to", dbPath)
+		db, err := ab.OpenDB(dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ab.ZTree = &ztree.ZTree{DB: db}
+	default:
+		log.Fatalf("Unknown STORAGE_ENGINE %q, expected sqlite, txnlog or memory", storageEngine)
+	}
+	ab.StatePath = statePath(dbPath)
+	if err := ab.loadElectionState(); err != nil {
 		log.Fatal(err)
 	}
-	ab.ZTree = &ztree.ZTree{DB: db}
 	ab.Read.ab = ab
 	ab.Write.ab = ab
 	ab.Proposal.ab = ab
 	ab.Election.ab = ab
 	ab.Sync.ab = ab
+	ab.Admin.ab = ab
+
+	ab.PreVote = os.Getenv("PRE_VOTE") == "true"
+	ab.ProposalTimeout = 10 * time.Second
+	if timeout, err := strconv.Atoi(os.Getenv("PROPOSAL_TIMEOUT")); err == nil && timeout > 0 {
+		ab.ProposalTimeout = time.Duration(timeout) * time.Second
+	}
+	ab.QuorumLossTimeout = 15 * time.Second
+	if timeout, err := strconv.Atoi(os.Getenv("QUORUM_LOSS_TIMEOUT")); err == nil && timeout > 0 {
+		ab.QuorumLossTimeout = time.Duration(timeout) * time.Second
+	}
+	if lease, err := strconv.Atoi(os.Getenv("LEADER_LEASE")); err == nil && lease > 0 {
+		ab.LeaderLease = time.Duration(lease) * time.Second
+	}
+	ab.MaxClockDrift = 500 * time.Millisecond
+	if drift, err := strconv.Atoi(os.Getenv("MAX_CLOCK_DRIFT")); err == nil && drift >= 0 {
+		ab.MaxClockDrift = time.Duration(drift) * time.Millisecond
+	}
+	ab.SyncTimeout = 5 * time.Second
+	if timeout, err := strconv.Atoi(os.Getenv("SYNC_TIMEOUT")); err == nil && timeout > 0 {
+		ab.SyncTimeout = time.Duration(timeout) * time.Second
+	}
+	ab.SyncMaxBytes = 256 << 20
+	if maxMb, err := strconv.Atoi(os.Getenv("SYNC_MAX_MB")); err == nil && maxMb > 0 {
+		ab.SyncMaxBytes = int64(maxMb) << 20
+	}
+	ab.ReadOnlyMode = os.Getenv("READ_ONLY_MODE") == "true"
+	ab.lastContact = make(map[string]time.Time)
+	ab.TickTime = 2000 * time.Millisecond
+	if tickTime, err := strconv.Atoi(os.Getenv("TICK_TIME")); err == nil && tickTime > 0 {
+		ab.TickTime = time.Duration(tickTime) * time.Millisecond
+	}
+	ab.SyncLimit = 5
+	if syncLimit, err := strconv.Atoi(os.Getenv("SYNC_LIMIT")); err == nil && syncLimit > 0 {
+		ab.SyncLimit = syncLimit
+	}
+	ab.followerZxid = make(map[string]int)
+	ab.followerDiverged = make(map[string]bool)
+	ab.PhiThreshold = 8
+	if threshold, err := strconv.ParseFloat(os.Getenv("PHI_THRESHOLD"), 64); err == nil && threshold > 0 {
+		ab.PhiThreshold = threshold
+	}
+	ab.detectors = make(map[string]*PhiAccrualDetector)
+	if versions, err := strconv.Atoi(os.Getenv("RETENTION_VERSIONS")); err == nil && versions > 0 {
+		ab.RetentionVersions = versions
+	}
+	if hours, err := strconv.Atoi(os.Getenv("RETENTION_HOURS")); err == nil && hours > 0 {
+		ab.RetentionHours = hours
+	}
+	ab.CompactionInterval = 60 * time.Second
+	if interval, err := strconv.Atoi(os.Getenv("COMPACTION_INTERVAL")); err == nil && interval > 0 {
+		ab.CompactionInterval = time.Duration(interval) * time.Second
+	}
+	ab.loadQuorumConfig()
+	ab.SetObservers(strings.Split(os.Getenv("OBSERVERS"), ","))
+
+	ab.Election.Strategy = ab.electionStrategy(os.Getenv("ELECTION_STRATEGY"))
 
 	ab.proposalState = COMMITTED
+	ab.acks = make(map[string]bool)
+	ab.syncAcks = make(map[string]bool)
 
 	ab.ErrorLeaderChan = make(chan data.HealthCheckError)
 
@@ -115,9 +556,12 @@ func (ab *AtomicBroadcast) CreateMetadataFromPayload(w http.ResponseWriter, r *h
 	ab.readJSON(w, r, &requestPayload)
 
 	data := data.Data{
+		RequestId:   requestPayload.RequestId,
+		ProposalId:  requestPayload.ProposalId,
 		Timestamp:   requestPayload.Timestamp,
 		Metadata:    requestPayload.Metadata,
 		GameResults: requestPayload.GameResults,
+		Reconfig:    requestPayload.Reconfig,
 	}
 	return data
 }
@@ -140,6 +584,7 @@ func (ab *AtomicBroadcast) EnableCORS(h http.Handler) http.Handler {
 
 type JSONResponse struct {
 	Error   bool        `json:"error"`
+	Code    string      `json:"code,omitempty"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
 }
@@ -167,9 +612,15 @@ func (ab *AtomicBroadcast) writeJSON(w http.ResponseWriter, status int, data int
 
 	return nil
 }
+
 func (ab *AtomicBroadcast) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1024 * 1024 // 1mb
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	return ab.readJSONLimit(w, r, data, int64(maxBytes))
+}
+
+// readJSONLimit for the larger bodies of a sync, such as a Snapshot
+func (ab *AtomicBroadcast) readJSONLimit(w http.ResponseWriter, r *http.Request, data interface{}, maxBytes int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
@@ -196,14 +647,16 @@ func (ab *AtomicBroadcast) sendRequest(incomingUrl string, method string, jsonDa
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 
-	zNode, err := ab.ZTree.GetLocalMetadata()
-	req.Header.Add("X-Sender-Port", zNode.NodePort)
+	local, err := ab.ZTree.GetLocalState()
+	req.Header.Add("X-Sender-Port", local.NodePort)
+	req.Header.Add("X-Epoch", strconv.Itoa(ab.Epoch()))
 
 	res, err := client.Do(req)
 	if err != nil {
 		//log.Println("Error sending request:", err)
 		return nil, err
 	}
+	ab.checkFenced(res)
 
 	return res, nil
 }
@@ -3,7 +3,10 @@ package zab
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/fatih/color"
+	"github.com/tnbl265/zooweeper/request_processors/data"
 	"net/http"
+	"strconv"
 )
 
 // WriteOps for WriteRequest
@@ -18,11 +21,28 @@ func (wo *WriteOps) UpdateMetadata(http.ResponseWriter, *http.Request) {
 // WriteMetadata handler to write into ZTree using InsertMetadataWithParent
 func (wo *WriteOps) WriteMetadata(w http.ResponseWriter, r *http.Request) {
 	data := wo.ab.CreateMetadataFromPayload(w, r)
-	wo.ab.ZTree.InsertMetadataWithParent(data.Metadata)
+	if data.Reconfig != nil {
+		// Reconfig only changes the ensemble membership, no ZNode for Kafka broker
+		wo.ab.applyReconfig(*data.Reconfig)
+		zxid, _ := wo.ab.ZTree.GetHighestZNodeId()
+		wo.ab.commitProposal(data.ProposalId, zxid)
+		wo.ab.writeJSON(w, http.StatusOK, committedResponse(zxid, data.RequestId))
+		return
+	}
+	// ZNode written at the Transaction Timestamp unless the client gave one, used by the retention
+	if data.Metadata.Timestamp == "" {
+		data.Metadata.Timestamp = data.Timestamp
+	}
+	nodeId, err := wo.ab.ZTree.InsertMetadataWithParent(data.Metadata)
+	if err != nil {
+		color.Red("Error inserting metadata: %s", err)
+		wo.ab.WriteError(w, err)
+		return
+	}
 
 	// Only modify Kafka broker metadata if it is a leader
-	zNode, _ := wo.ab.ZTree.GetLocalMetadata()
-	if zNode.NodePort == zNode.Leader {
+	local, _ := wo.ab.ZTree.GetLocalState()
+	if local.NodePort == local.Leader {
 		ports, _ := wo.ab.ZTree.GetClients(data.Metadata.SenderIp)
 		jsonData, _ := json.Marshal(data.GameResults)
 		for _, port := range ports {
@@ -31,6 +51,71 @@ func (wo *WriteOps) WriteMetadata(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	wo.ab.writeJSON(w, http.StatusOK, data)
-	wo.ab.SetProposalState(COMMITTED)
+	// Remember the result on every server, so any future Leader can answer a retry
+	response := committedResponse(nodeId, data.RequestId)
+	if data.RequestId != "" {
+		result, _ := json.Marshal(response)
+		wo.ab.ZTree.InsertRequestResult(data.RequestId, string(result))
+	}
+
+	wo.ab.commitProposal(data.ProposalId, nodeId)
+	wo.ab.writeJSON(w, http.StatusOK, response)
+}
+
+// WriteCommittedResponse to the client (Kafka broker) once its Write Request is committed, with the committed zxid
+func (ab *AtomicBroadcast) WriteCommittedResponse(w http.ResponseWriter, result data.ZxidResult) {
+	w.Header().Set("X-Zxid", strconv.Itoa(result.Zxid))
+	_ = ab.writeJSON(w, http.StatusOK, committedResponse(result.Zxid, result.RequestId))
+}
+
+// committedResponse returned to the client (Kafka broker) once its Write Request is committed, Zxid being the NodeId
+// of its ZNode
+func committedResponse(zxid int, requestId string) JSONResponse {
+	return JSONResponse{
+		Message: "Committed",
+		Data: data.ZxidResult{
+			Zxid:      zxid,
+			RequestId: requestId,
+		},
+	}
+}
+
+// committedResult of a Write Request committed by the local /writeMetadata, or remembered in the RequestLog when its
+// response was lost
+func (ab *AtomicBroadcast) committedResult(resp *http.Response, d data.Data) data.ZxidResult {
+	var response struct {
+		Data data.ZxidResult `json:"data"`
+	}
+	if resp != nil && resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&response) == nil {
+		return response.Data
+	}
+	if result, exists, err := ab.ZTree.GetRequestResult(d.RequestId); err == nil && exists &&
+		json.Unmarshal([]byte(result), &response) == nil {
+		return response.Data
+	}
+	zxid, _ := ab.ZTree.GetHighestZNodeId()
+	return data.ZxidResult{Zxid: zxid, RequestId: d.RequestId}
+}
+
+// WriteCommittedResult of a RequestId that was already committed instead of committing it again
+func (ab *AtomicBroadcast) WriteCommittedResult(w http.ResponseWriter, requestId string) bool {
+	if requestId == "" {
+		return false
+	}
+	result, exists, err := ab.ZTree.GetRequestResult(requestId)
+	if err != nil || !exists {
+		return false
+	}
+
+	var response struct {
+		Data data.ZxidResult `json:"data"`
+	}
+	_ = json.Unmarshal([]byte(result), &response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-ZooWeeper-Duplicate", "true")
+	w.Header().Set("X-Zxid", strconv.Itoa(response.Data.Zxid))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(result))
+	return true
 }
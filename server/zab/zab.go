@@ -1,14 +1,18 @@
 // Package zab implements the Atomic Broadcast component for our ZooWeeper.
 //
-// 1. Make use of simple majority quorum to decide on proposal for Data Synchronization
+// 1. Make use of a QuorumVerifier (simple majority by default, weighted or hierarchical with QUORUM) to decide on
+// proposal for Data Synchronization, Observers (OBSERVERS) are not counted in the quorum and only receive committed
+// Transaction through INFORM
 // 2. Instead of using TCP, we use HTTP with the additional of a QueueMiddleware to ensure FIFO client order by ordering
 // Transaction by Timestamp generated by client (Kafka broker)
 // 3. Each Transaction from client (Kafka broker) would be recorded into ZTree as a ZNode
 // 4. Below are the operations handled by zab:
 //   - Write/Read: requests from client (Kafka broker)
 //   - Proposal: Active Messaging for Data Synchronization of Write Request
-//   - Election: Leader Election using Bully Algorithm
+//   - Election: Leader heartbeats to detect failure, then Leader Election using Bully Algorithm or Fast Leader Election
+//     (ELECTION_STRATEGY=fast)
 //   - Sync: Data Synchronization when a ZooWeeper restart
+//   - Admin: operations on the ensemble itself, e.g. Reconfig of its members committed as a Transaction
 //
 // Reference: Apache ZooKeeper https://zookeeper.apache.org/doc/current/zookeeperInternals.html
 package zab
@@ -20,8 +24,6 @@ import (
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/tnbl265/zooweeper/request_processors/data"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -40,20 +42,92 @@ type AtomicBroadcast struct {
 	Proposal ProposalOps
 	Election ElectionOps
 	Sync     SyncOps
+	Admin    AdminOps
 
 	ZTree ztree.ZNodeHandlers
 
-	// Proposal
-	ackCounter    int
-	proposalState ProposalState
-	proposalMu    sync.Mutex
+	// Proposal, aborted if not ACKed by a quorum within ProposalTimeout
+	ProposalTimeout time.Duration
+	proposalId      int
+	acks            map[string]bool
+	commits         map[string]bool // servers which committed the proposal, the client is answered once a quorum did
+	proposalState   ProposalState
+	committedId     int // highest proposal committed locally, the Leader only then asks its Followers to commit
+	committedZxid   int // of the committedId proposal, the NodeId of its ZNode
+	transferring    bool
+	proposalMu      sync.Mutex
 
 	// DataSync
-	syncCounter int
-	syncState   SyncState
-	syncMu      sync.Mutex
+	syncAcks  map[string]bool
+	syncState SyncState
+	syncMu    sync.Mutex
+
+	// Election, persisted in StatePath across restarts
+	StatePath     string
+	epoch         int
+	acceptedEpoch int
+	electionRound int
+	vote          data.Vote
+	electionMu    sync.Mutex
 
 	ErrorLeaderChan chan data.HealthCheckError
+
+	// Quorum loss, the Leader steps down and servers optionally turn read-only
+	QuorumLossTimeout time.Duration
+	LeaderLease       time.Duration // derived from the election timeout less MaxClockDrift unless set
+	MaxClockDrift     time.Duration
+	ReadOnlyMode      bool
+	readOnly          bool
+	lastContact       map[string]time.Time
+	draining          bool
+	healthStopped     bool // only once drained, a draining Leader keeps heartbeating until it handed off leadership
+	healthMu          sync.Mutex
+
+	// Heartbeat from the Leader every TickTime, a Follower suspects the Leader after SyncLimit ticks without one
+	TickTime        time.Duration
+	SyncLimit       int
+	leaderHeartbeat data.Heartbeat
+	heartbeatAt     time.Time
+	followerZxid    map[string]int
+	// followerDiverged from the Leader, as reported in their HeartbeatAck
+	followerDiverged map[string]bool
+
+	// PhiThreshold of the PhiAccrualDetector above which a server is suspected
+	PhiThreshold float64
+	detectors    map[string]*PhiAccrualDetector
+
+	// Retention of the superseded versions of a process ZNode, purged every CompactionInterval
+	RetentionVersions  int
+	RetentionHours     int
+	CompactionInterval time.Duration
+	purgeSyncing       bool // catching up on the versions purged by the Leader, guarded by digestMu
+
+	// Divergence of the ZTree from the Leader, detected by comparing their digests and fixed by a snapshot resync
+	divergence *data.Divergence
+	resyncing  bool
+	resyncs    int
+	lastResync time.Time
+	retryAt    time.Time // of a failed resync, instead of at every heartbeat
+	digestMu   sync.Mutex
+
+	// PreVote before starting an election, to stick to a healthy Leader
+	PreVote bool
+
+	// Observers receive committed Transaction but are not counted in any quorum
+	observers map[string]bool
+	// members by server ID from the CONFIG_FILE, otherwise a server ID is its port on BaseURL
+	members  map[string]data.Member
+	configMu sync.Mutex
+
+	// Read consistency, how long a Read Request may wait for this server to catch up
+	SyncTimeout time.Duration
+	// SyncMaxBytes of a Snapshot or missing Metadata sent to a server catching up, other bodies are limited to 1mb
+	SyncMaxBytes int64
+
+	// Quorum of the ensemble: majority (default), weighted or hierarchical
+	Quorum        string
+	QuorumWeights string
+	QuorumGroups  string
 }
 
 // ProposalState for 2PC of Write Request (Ref: Active Messaging in https://zookeeper.apache.org/doc/current/zookeeperInternals.html#sc_activeMessaging)
@@ -63,6 +137,7 @@ const (
 	PROPOSED     ProposalState = "PROPOSED"
 	ACKNOWLEDGED ProposalState = "ACKNOWLEDGED"
 	COMMITTED    ProposalState = "COMMITTED"
+	ABORTED      ProposalState = "ABORTED"
 )
 
 // SyncState using same logic as ProposalState
@@ -76,150 +151,118 @@ const (
 
 var err error
 
-// StartHealthCheck by pinging all other servers to perform HealthCheck, write data to ErrorLeaderChan upon timing out
-func (ab *AtomicBroadcast) StartHealthCheck() {
-	const PING_TIMEOUT = 5
-	const REQUEST_TIMEOUT = 2
-
-	for {
-		time.Sleep(time.Second * time.Duration(PING_TIMEOUT))
-		zNode, _ := ab.ZTree.GetLocalMetadata()
-		currentPort := zNode.NodePort
-
-		var healthCheck = data.HealthCheck{
-			Message:    "ping!",
-			PortNumber: currentPort,
-		}
-		jsonData, _ := json.Marshal(healthCheck)
-
-		servers := strings.Split(zNode.Servers, ",")
-		for _, otherPort := range servers {
-			if currentPort == otherPort {
-				continue
-			}
-			client := &http.Client{}
-			url := fmt.Sprintf(ab.BaseURL + ":" + otherPort + "/")
-
-			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			req.Header.Add("Accept", "application/json")
-			req.Header.Add("Content-Type", "application/json")
-			req.Header.Add("X-Sender-Port", zNode.NodePort)
-
-			color.Green("Ping %s", otherPort)
-
-			ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT*time.Second)
-			defer cancel()
-
-			req = req.WithContext(ctx)
-
-			// CONNECTION
-			resp, err := client.Do(req)
-			if resp == nil && err != nil {
-				if ctxErr := ctx.Err(); ctxErr == context.DeadlineExceeded {
-					color.Red("Timeout Occurred!")
-				}
-			}
-			if err != nil || resp == nil {
-				color.Red("Error sending ping to %s", otherPort)
-
-				errorData := data.HealthCheckError{
-					Error:     err,
-					ErrorPort: otherPort,
-					IsWakeup:  false,
-				}
-				ab.ErrorLeaderChan <- errorData
-				continue
-			}
-
-			// REPLY
-			defer resp.Body.Close()
-			resBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			var responseObject data.HealthCheck
-			json.Unmarshal(resBody, &responseObject)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-			// Port number
-			color.Green("%s Pong", responseObject.PortNumber)
-		}
-	}
-}
-
-// ForwardRequestToLeader for Follower to forward Write Request to Leader
+// ForwardRequestToLeader for Follower to forward Write Request (or linearizable Read Request) to Leader
 func (ab *AtomicBroadcast) ForwardRequestToLeader(r *http.Request) (*http.Response, error) {
-	zNode, _ := ab.ZTree.GetLocalMetadata()
-	req, _ := http.NewRequest(r.Method, ab.BaseURL+":"+zNode.Leader+r.URL.Path, r.Body)
+	local, _ := ab.ZTree.GetLocalState()
+	req, _ := http.NewRequest(r.Method, ab.clientURL(local.Leader)+r.URL.RequestURI(), r.Body)
 	req.Header = r.Header
 	client := &http.Client{}
 	return client.Do(req)
 }
 
-// StartProposal for Leader to start a 2PC Active Messaging
-func (ab *AtomicBroadcast) StartProposal(data data.Data) {
-	ab.SetProposalState(PROPOSED)
-
+// StartProposal for Leader to start a 2PC Active Messaging, aborting with ErrProposalTimeout if a quorum never ACK,
+// refused with ErrLeaderTransfer during a leadership transfer
+func (ab *AtomicBroadcast) StartProposal(data data.Data) (result data.ZxidResult, err error) {
+	if data.Reconfig != nil {
+		reconfig := ab.resolveReconfig(*data.Reconfig)
+		data.Reconfig = &reconfig
+	}
+	local, _ := ab.ZTree.GetLocalState()
+	proposalId, err := ab.newProposal(local.NodePort)
+	if err != nil {
+		return result, err
+	}
+	data.ProposalId = proposalId
 	jsonData, _ := json.Marshal(data)
-	zNode, _ := ab.ZTree.GetLocalMetadata()
-	portsSlice := strings.Split(zNode.Servers, ",")
+	portsSlice := strings.Split(local.Servers, ",")
 
-	// send Request async
-	var wg sync.WaitGroup
-	for _, port := range portsSlice {
-		if port == zNode.NodePort {
+	// send Request async, a Follower only returns once the Leader asked it to commit
+	for _, port := range ab.votingMembers(portsSlice) {
+		if port == local.NodePort {
 			continue
 		}
 
-		wg.Add(1)
 		go func(port string) {
-			defer wg.Done()
-
-			color.HiBlue("Leader %s proposing to Follower %s", zNode.NodePort, port)
-			url := ab.BaseURL + ":" + port + "/proposeWrite"
+			color.HiBlue("Leader %s proposing to Follower %s", local.NodePort, port)
+			url := ab.peerURL(port) + "/proposeWrite"
 			_, err := ab.sendRequest(url, "POST", jsonData)
 			if err != nil {
 				color.Red("Error proposing to follower:", port, "Error:", err)
 			}
 		}(port)
 	}
-	wg.Wait()
 
-	// Wait for ACK before committing
+	// Wait for ACK before committing, abort once the deadline passed
+	deadline := time.Now().Add(ab.ProposalTimeout)
 	for ab.ProposalState() != ACKNOWLEDGED {
-		time.Sleep(time.Second)
+		if time.Now().After(deadline) && ab.abortProposal() {
+			color.Red("Leader %s aborted proposal after %s without quorum", local.NodePort, ab.ProposalTimeout)
+			return result, ErrProposalTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
 
-	color.HiBlue("Leader %s committing", zNode.NodePort)
-	url := ab.BaseURL + ":" + zNode.NodePort + "/writeMetadata"
-	_, err := ab.sendRequest(url, "POST", jsonData)
-	if err != nil {
-		color.Red("Error committing write metadata:", err)
+	color.HiBlue("Leader %s committing", local.NodePort)
+	url := ab.peerURL(local.NodePort) + "/writeMetadata"
+	resp, err := ab.sendRequest(url, "POST", jsonData)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	if committed, _ := ab.proposalOutcome(data.ProposalId); !committed {
+		// Followers were not asked to commit either, the proposal is aborted everywhere
+		color.Red("Error committing write metadata: %v", err)
+		ab.SetProposalState(ABORTED)
+		return result, ErrCommitFailed
 	}
+	result = ab.committedResult(resp, data)
+
+	// A quorum must hold the Transaction before the client hears it committed, or a crash of the Leader could lose it
+	verifier := ab.quorumVerifier(ab.votingMembers(portsSlice))
+	deadline = time.Now().Add(ab.ProposalTimeout)
+	commits, current := ab.addCommit(data.ProposalId, local.NodePort)
+	for current && !verifier.ContainsQuorum(commits) {
+		if time.Now().After(deadline) {
+			color.Red("Leader %s committed proposal %d without hearing from a quorum of Followers", local.NodePort, data.ProposalId)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+		commits, current = ab.addCommit(data.ProposalId, "")
+	}
+
+	// INFORM Observers of the committed Transaction, as well as new members after a Reconfig
+	local, _ = ab.ZTree.GetLocalState()
+	proposedTo := make(map[string]bool)
+	for _, port := range ab.votingMembers(portsSlice) {
+		proposedTo[port] = true
+	}
+	for _, port := range strings.Split(local.Servers, ",") {
+		if port == local.NodePort || proposedTo[port] {
+			continue
+		}
+		color.HiBlue("Leader %s informing %s", local.NodePort, port)
+		url := ab.peerURL(port) + "/inform"
+		_, err := ab.sendRequest(url, "POST", jsonData)
+		if err != nil {
+			color.Red("Error informing observer %s: %s", port, err)
+		}
+	}
+	return result, nil
 }
 
 // syncMetadata for new leader to sync its transaction log on joining or restart
 func (ab *AtomicBroadcast) syncMetadata() {
+	local, _ := ab.ZTree.GetLocalState()
+	ab.ResetSyncAcks(local.NodePort)
 	ab.SetSyncState(PREPARED)
-
-	zNode, _ := ab.ZTree.GetLocalMetadata()
-	portsSlice := strings.Split(zNode.Servers, ",")
+	portsSlice := strings.Split(local.Servers, ",")
 
 	var metadata ztree.Metadata
 	jsonData, _ := json.Marshal(metadata)
 
 	// send Request async
 	var wg sync.WaitGroup
-	for _, port := range portsSlice {
-		if port == zNode.NodePort {
+	for _, port := range ab.votingMembers(portsSlice) {
+		if port == local.NodePort {
 			continue
 		}
 
@@ -227,8 +270,8 @@ func (ab *AtomicBroadcast) syncMetadata() {
 		go func(port string) {
 			defer wg.Done()
 
-			color.Yellow("%s send syncRequest to %s", zNode.NodePort, port)
-			url := ab.BaseURL + ":" + port + "/syncRequest"
+			color.Yellow("%s send syncRequest to %s", local.NodePort, port)
+			url := ab.peerURL(port) + "/syncRequest"
 			_, err := ab.sendRequest(url, "POST", jsonData)
 			if err != nil {
 				color.Red("Error syncRequest to %s:", port, "Error:", err)
@@ -237,8 +280,13 @@ func (ab *AtomicBroadcast) syncMetadata() {
 	}
 	wg.Wait()
 
-	// Wait for ACK before request Metadata
+	// Wait for ACK before request Metadata, without a quorum still pull from whoever is reachable
+	deadline := time.Now().Add(ab.ProposalTimeout)
 	for ab.SyncState() != ACKED {
+		if time.Now().After(deadline) {
+			color.Red("%s did not receive a quorum of syncAck", local.NodePort)
+			break
+		}
 		time.Sleep(time.Second)
 	}
 
@@ -249,19 +297,19 @@ func (ab *AtomicBroadcast) syncMetadata() {
 	jsonData, _ = json.Marshal(metadata)
 
 	for _, port := range portsSlice {
-		if port == zNode.NodePort {
+		if port == local.NodePort {
 			continue
 		}
 
-		color.Yellow("%s requestMetadata from %s", zNode.NodePort, port)
-		url := ab.BaseURL + ":" + port + "/requestMetadata"
+		color.Yellow("%s requestMetadata from %s", local.NodePort, port)
+		url := ab.peerURL(port) + "/requestMetadata"
 		_, err := ab.sendRequest(url, "POST", jsonData)
 		if err != nil {
 			color.Red("Error requestMetadata to:", port, "Error:", err)
 		}
 	}
 
-	color.Yellow("%s finished syncing", zNode.NodePort)
+	color.Yellow("%s finished syncing", local.NodePort)
 	ab.SetSyncState(SYNCED)
 }
 
@@ -283,16 +331,24 @@ func (ab *AtomicBroadcast) WakeupLeaderElection(port int) {
 }
 
 // ListenForLeaderElection when there is data from ErrorLeaderChan due to TimeOut
-func (ab *AtomicBroadcast) ListenForLeaderElection(port int, leader int) {
+func (ab *AtomicBroadcast) ListenForLeaderElection(port int) {
 	for {
 		select {
 		case errorData := <-ab.ErrorLeaderChan:
-			errorPortNumber, _ := strconv.Atoi(errorData.ErrorPort)
-			if errorPortNumber == leader || errorData.IsWakeup {
+			local, _ := ab.ZTree.GetLocalState()
+			if errorData.ErrorPort == local.Leader || errorData.IsWakeup {
+				if ab.IsObserver(strconv.Itoa(port)) {
+					// Observers never stand for election, they wait to be told of the new Leader
+					ab.joinHealthyLeader(port)
+					continue
+				}
+				if ab.PreVote && ab.joinHealthyLeader(port) {
+					continue
+				}
 				if errorData.IsWakeup {
 					color.Cyan("%d joining, starting election", port)
-				} else if errorPortNumber == leader {
-					color.Cyan("Healthcheck timeout for %d, starting election", errorPortNumber)
+				} else {
+					color.Cyan("Healthcheck timeout for %s, starting election", errorData.ErrorPort)
 				}
 				ab.startLeaderElection(port)
 			}
@@ -300,12 +356,102 @@ func (ab *AtomicBroadcast) ListenForLeaderElection(port int, leader int) {
 	}
 }
 
+// joinHealthyLeader runs a pre-vote, joining as Follower if a quorum of servers still follows a healthy Leader
+func (ab *AtomicBroadcast) joinHealthyLeader(port int) bool {
+	const REQUEST_TIMEOUT = 2
+	portStr := strconv.Itoa(port)
+
+	local, _ := ab.ZTree.GetLocalState()
+	servers := ab.votingMembers(strings.Split(local.Servers, ","))
+
+	followers := make(map[string]map[string]bool)
+	epochs := make(map[string]int)
+	for _, otherPort := range servers {
+		if otherPort == portStr {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "POST", ab.peerURL(otherPort)+"/preVote", nil)
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("X-Sender-Port", portStr)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			continue
+		}
+		var responseObject data.PreVoteResponse
+		err = json.NewDecoder(resp.Body).Decode(&responseObject)
+		resp.Body.Close()
+		cancel()
+		if err != nil || responseObject.Leader == "" {
+			continue
+		}
+
+		if followers[responseObject.Leader] == nil {
+			followers[responseObject.Leader] = make(map[string]bool)
+		}
+		followers[responseObject.Leader][otherPort] = true
+		if responseObject.Epoch > epochs[responseObject.Leader] {
+			epochs[responseObject.Leader] = responseObject.Epoch
+		}
+	}
+
+	verifier := ab.quorumVerifier(servers)
+	for leader, acks := range followers {
+		// A restarted server can not stick to itself, and the Leader must be backed by a quorum
+		if leader == portStr || !verifier.ContainsQuorum(acks) {
+			continue
+		}
+		if !ab.isAlive(leader) {
+			continue
+		}
+
+		if epochs[leader] > ab.Epoch() {
+			if err := ab.SetEpoch(epochs[leader]); err != nil {
+				color.Red("%s could not follow Leader %s of epoch %d: %s", portStr, leader, epochs[leader], err)
+				return false
+			}
+		}
+		color.Cyan("%s found healthy Leader %s followed by %d servers, joining as Follower", portStr, leader, len(acks))
+		if leader != local.Leader {
+			ab.ZTree.UpdateLeader(leader)
+		}
+		ab.syncMetadata()
+		return true
+	}
+
+	color.Cyan("%s found no healthy Leader with a quorum", portStr)
+	return false
+}
+
+// isAlive pings a single server once
+func (ab *AtomicBroadcast) isAlive(port string) bool {
+	const REQUEST_TIMEOUT = 2
+
+	jsonData, _ := json.Marshal(data.HealthCheck{Message: "ping!"})
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", ab.peerURL(port)+"/", bytes.NewBuffer(jsonData))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
 // startLeaderElection starts Bully by calling its own server handler with information of the port information.
 func (ab *AtomicBroadcast) startLeaderElection(currentPort int) {
 	client := &http.Client{}
 	portURL := fmt.Sprintf("%d", currentPort)
 
-	url := fmt.Sprintf(ab.BaseURL + ":" + portURL + "/electLeader")
+	url := ab.peerURL(portURL) + "/electLeader"
 	var electMessage = data.ElectLeaderRequest{
 		IncomingPort: fmt.Sprintf("%d", currentPort),
 	}
@@ -316,19 +462,24 @@ func (ab *AtomicBroadcast) startLeaderElection(currentPort int) {
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, _ := client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		color.Red("Error starting election on %d: %s", currentPort, err)
+		return
+	}
 	defer resp.Body.Close()
 }
 
-// declareLeaderRequest sends <declare-leader> message to all Followers
-func (ab *AtomicBroadcast) declareLeaderRequest(portStr string, allServers []string) {
+// declareLeaderRequest sends <declare-leader> message with the new epoch to all Followers
+func (ab *AtomicBroadcast) declareLeaderRequest(portStr string, epoch int, allServers []string) {
 	for _, outgoingPort := range allServers {
 		client := &http.Client{}
 		portURL := fmt.Sprintf("%s", outgoingPort)
 
-		url := fmt.Sprintf(ab.BaseURL + ":" + portURL + "/declareLeaderReceive")
+		url := ab.peerURL(portURL) + "/declareLeaderReceive"
 		var electMessage = data.DeclareLeaderRequest{
 			IncomingPort: portStr,
+			Epoch:        epoch,
 		}
 		jsonData, _ := json.Marshal(electMessage)
 
@@ -338,6 +489,7 @@ func (ab *AtomicBroadcast) declareLeaderRequest(portStr string, allServers []str
 		}
 		req.Header.Add("Accept", "application/json")
 		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("X-Epoch", strconv.Itoa(ab.Epoch()))
 
 		color.Cyan("%s declare Leader to %s", portStr, outgoingPort)
 		resp, err := client.Do(req)
@@ -345,5 +497,6 @@ func (ab *AtomicBroadcast) declareLeaderRequest(portStr string, allServers []str
 			continue
 		}
 		defer resp.Body.Close()
+		ab.checkFenced(resp)
 	}
 }
@@ -0,0 +1,463 @@
+package ztree
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// backends every ZNodeHandlers implementation must behave the same on, each test gets a fresh initialized one
+var backends = map[string]func(t *testing.T) ZNodeHandlers{
+	"sqlite": func(t *testing.T) ZNodeHandlers {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "zooweeper-metadata.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zt := &ZTree{DB: db}
+		zt.InitializeDB()
+		t.Cleanup(func() { zt.Close() })
+		return zt
+	},
+	"memory": func(t *testing.T) ZNodeHandlers {
+		mt := NewMemoryTree()
+		mt.InitializeDB()
+		return mt
+	},
+	"txnlog": func(t *testing.T) ZNodeHandlers {
+		tt := NewTxnLogTree(t.TempDir(), 10000)
+		tt.InitializeDB()
+		t.Cleanup(func() { tt.Close() })
+		return tt
+	},
+}
+
+func conformance(t *testing.T, test func(t *testing.T, zt ZNodeHandlers)) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+func write(t *testing.T, zt ZNodeHandlers, senderIp, clients, timestamp string) int {
+	t.Helper()
+	nodeId, err := zt.InsertMetadataWithParent(Metadata{
+		Timestamp:  timestamp,
+		Clients:    clients,
+		SenderIp:   senderIp,
+		ReceiverIp: "8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodeId
+}
+
+func nodeIds(metadatas []*Metadata) []int {
+	var ids []int
+	for _, metadata := range metadatas {
+		ids = append(ids, metadata.NodeId)
+	}
+	return ids
+}
+
+func expectIds(t *testing.T, got, want []int) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got NodeId %v, want %v", got, want)
+	}
+}
+
+func TestConformanceRoot(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		highest, err := zt.GetHighestZNodeId()
+		if err != nil || highest != 1 {
+			t.Fatalf("highest ZNodeId %d, %v", highest, err)
+		}
+		exists, _ := zt.ZNodeIdExists(1)
+		if !exists {
+			t.Fatal("no root ZNode")
+		}
+		exists, _ = zt.ZNodeIdExists(2)
+		if exists {
+			t.Fatal("unexpected ZNode 2")
+		}
+	})
+}
+
+func TestConformanceInsertMetadataWithParent(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		written := []int{
+			write(t, zt, "9090", "9090", "2024-01-01T10:00:00Z"),
+			write(t, zt, "9090", "9090", "2024-01-01T10:01:00Z"),
+			write(t, zt, "9091", "9091", "2024-01-01T10:02:00Z"),
+			write(t, zt, "9090", "9090,9092", "2024-01-01T10:03:00Z"),
+		}
+		// Unchanged Clients insert nothing, the NodeId of the latest version is returned instead
+		expectIds(t, written, []int{2, 2, 3, 4})
+
+		metadatas, _ := zt.AllMetadata()
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 3, 4})
+
+		want := []Metadata{
+			{NodeId: 2, Version: 0, ParentId: 1, Clients: "9090", SenderIp: "9090"},
+			{NodeId: 3, Version: 0, ParentId: 1, Clients: "9091", SenderIp: "9091"},
+			{NodeId: 4, Version: 1, ParentId: 2, Clients: "9090,9092", SenderIp: "9090"},
+		}
+		for i, w := range want {
+			got := metadatas[i+1]
+			if got.NodeId != w.NodeId || got.Version != w.Version || got.ParentId != w.ParentId ||
+				got.Clients != w.Clients || got.SenderIp != w.SenderIp || got.ReceiverIp != "8080" {
+				t.Fatalf("got %+v, want %+v", *got, w)
+			}
+		}
+		if metadatas[3].Timestamp != "2024-01-01T10:03:00Z" {
+			t.Fatalf("got Timestamp %s", metadatas[3].Timestamp)
+		}
+
+		// Clients of the first ZNode of a client
+		clients, _ := zt.GetClients("9090")
+		if fmt.Sprint(clients) != "[9090]" {
+			t.Fatalf("got Clients %v", clients)
+		}
+		clients, _ = zt.GetClients("9999")
+		if fmt.Sprint(clients) != "[]" {
+			t.Fatalf("got Clients %v for unknown client", clients)
+		}
+	})
+}
+
+func TestConformanceInsertMetadata(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		for _, nodeId := range []int{3, 2} {
+			err := zt.InsertMetadata(Metadata{NodeId: nodeId, ParentId: 1, Clients: "9090", SenderIp: "9090"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zt.InsertMetadata(Metadata{NodeId: 2}); err == nil {
+			t.Fatal("inserted ZNode 2 twice")
+		}
+
+		highest, _ := zt.GetHighestZNodeId()
+		if highest != 3 {
+			t.Fatalf("highest ZNodeId %d", highest)
+		}
+		metadatas, _ := zt.GetMetadatasGreaterThanZNodeId(1)
+		var ids []int
+		for _, metadata := range metadatas.MetadataList {
+			ids = append(ids, metadata.NodeId)
+		}
+		expectIds(t, ids, []int{2, 3})
+
+		metadatas, _ = zt.GetMetadatasGreaterThanZNodeId(3)
+		if len(metadatas.MetadataList) != 0 {
+			t.Fatalf("got %d Metadata after the highest ZNodeId", len(metadatas.MetadataList))
+		}
+	})
+}
+
+func TestConformanceLocalState(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		if _, err := zt.GetLocalState(); err == nil {
+			t.Fatal("LocalState before InitLocalState")
+		}
+
+		err := zt.InitLocalState(LocalState{NodePort: "8080", Leader: "8082", Servers: "8080,8081,8082"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A restart keeps the existing LocalState
+		err = zt.InitLocalState(LocalState{NodePort: "8080", Leader: "8080", Servers: "8080"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := zt.UpdateLeader("8081"); err != nil {
+			t.Fatal(err)
+		}
+		if err := zt.UpdateEnsemble("8080,8081,8082,8083", "8083"); err != nil {
+			t.Fatal(err)
+		}
+
+		local, err := zt.GetLocalState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := LocalState{NodePort: "8080", Leader: "8081", Servers: "8080,8081,8082,8083", Observers: "8083"}
+		if *local != want {
+			t.Fatalf("got %+v, want %+v", *local, want)
+		}
+
+		// LocalState is not a ZNode
+		highest, _ := zt.GetHighestZNodeId()
+		if highest != 1 {
+			t.Fatalf("highest ZNodeId %d", highest)
+		}
+	})
+}
+
+func TestConformanceRequestResult(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		if _, ok, _ := zt.GetRequestResult("a"); ok {
+			t.Fatal("result of an unknown RequestId")
+		}
+		zt.InsertRequestResult("a", "1")
+		zt.InsertRequestResult("a", "2")
+		result, ok, err := zt.GetRequestResult("a")
+		if err != nil || !ok || result != "2" {
+			t.Fatalf("got %q, %v, %v", result, ok, err)
+		}
+
+		for i := 0; i < REQUEST_LOG_SIZE; i++ {
+			zt.InsertRequestResult(fmt.Sprintf("r%d", i), "")
+		}
+		if _, ok, _ := zt.GetRequestResult("a"); ok {
+			t.Fatal("RequestLog kept more than REQUEST_LOG_SIZE")
+		}
+		if _, ok, _ := zt.GetRequestResult(fmt.Sprintf("r%d", REQUEST_LOG_SIZE-1)); !ok {
+			t.Fatal("RequestLog lost the most recent RequestId")
+		}
+
+		entries, err := zt.GetRequestLog()
+		if err != nil || len(entries) != REQUEST_LOG_SIZE {
+			t.Fatalf("got %d entries, %v", len(entries), err)
+		}
+		if entries[0].RequestId != "r0" || entries[REQUEST_LOG_SIZE-1].RequestId != fmt.Sprintf("r%d", REQUEST_LOG_SIZE-1) {
+			t.Fatalf("got %+v first and %+v last", entries[0], entries[REQUEST_LOG_SIZE-1])
+		}
+	})
+}
+
+func TestConformanceHistory(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		for i := 0; i < 4; i++ {
+			write(t, zt, "9090", fmt.Sprintf("9090,%d", i), fmt.Sprintf("2024-01-01T10:0%d:00Z", i))
+		}
+		write(t, zt, "9091", "9091", "2024-01-01T10:05:00Z")
+
+		history, _ := zt.GetHistory("9090")
+		var ids []int
+		for i, metadata := range history {
+			ids = append(ids, metadata.NodeId)
+			if metadata.Version != i {
+				t.Fatalf("got Version %d at %d", metadata.Version, i)
+			}
+		}
+		expectIds(t, ids, []int{2, 3, 4, 5})
+
+		metadatas, _ := zt.AllMetadataAsOf(3)
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 3})
+
+		asOf, _ := time.Parse(time.RFC3339, "2024-01-01T10:02:30Z")
+		zxid, _ := zt.GetZNodeIdAsOfTime(asOf)
+		if zxid != 4 {
+			t.Fatalf("got zxid %d as of %s", zxid, asOf)
+		}
+		zxid, _ = zt.GetZNodeIdAsOfTime(asOf.Add(-time.Hour))
+		if zxid != 1 {
+			t.Fatalf("got zxid %d before any write", zxid)
+		}
+	})
+}
+
+func TestConformancePurgeHistory(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		for i := 0; i < 5; i++ {
+			write(t, zt, "9090", fmt.Sprintf("9090,%d", i), fmt.Sprintf("2024-01-01T10:0%d:00Z", i))
+		}
+		write(t, zt, "9091", "9091", "2024-01-01T10:05:00Z")
+
+		// Nothing to purge without a retention
+		purged, _ := zt.PurgeHistory(0, time.Time{})
+		if len(purged) != 0 {
+			t.Fatalf("purged %v without a retention", purged)
+		}
+
+		// Versions 1 to 3 are superseded, only 1 and 2 were written before 10:03
+		before, _ := time.Parse(time.RFC3339, "2024-01-01T10:03:00Z")
+		purged, err := zt.PurgeHistory(1, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIds(t, purged, []int{3, 4})
+		metadatas, _ := zt.AllMetadata()
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 5, 6, 7})
+
+		purged, _ = zt.PurgeHistory(1, time.Time{})
+		expectIds(t, purged, []int{5})
+		metadatas, _ = zt.AllMetadata()
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 6, 7})
+
+		purgedZxid, _ := zt.GetPurgedZxid()
+		if purgedZxid != 5 {
+			t.Fatalf("got PurgedZxid %d", purgedZxid)
+		}
+
+		// The next version still follows the highest ZNodeId
+		write(t, zt, "9090", "9090,5", "2024-01-01T10:06:00Z")
+		history, _ := zt.GetHistory("9090")
+		last := history[len(history)-1]
+		if last.NodeId != 8 || last.Version != 5 || last.ParentId != 2 {
+			t.Fatalf("got %+v", last)
+		}
+	})
+}
+
+func TestConformancePurgeZNodes(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		for i := 0; i < 4; i++ {
+			write(t, zt, "9090", fmt.Sprintf("9090,%d", i), "")
+		}
+		before, _ := zt.GetDigest()
+
+		// The Leader may have purged a ZNode this server does not have yet
+		err := zt.PurgeZNodes([]int{4, 3, 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadatas, _ := zt.AllMetadata()
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 5})
+
+		purgedZxid, _ := zt.GetPurgedZxid()
+		after, _ := zt.GetDigest()
+		if purgedZxid != 9 || after.Digest != before.Digest || after.PurgedDigest == before.PurgedDigest {
+			t.Fatalf("got PurgedZxid %d, digest %+v before and %+v after", purgedZxid, before, after)
+		}
+		if report, _ := zt.Verify(); !report.OK() {
+			t.Fatal(report.String())
+		}
+	})
+}
+
+func TestConformanceRestoreSnapshot(t *testing.T) {
+	conformance(t, func(t *testing.T, zt ZNodeHandlers) {
+		write(t, zt, "9090", "9090", "2024-01-01T10:00:00Z")
+
+		snapshot := withDigests(Snapshot{
+			PurgedZxid:   4,
+			PurgedDigest: 42,
+			MetadataList: []Metadata{
+				{NodeId: 1},
+				{NodeId: 2, ParentId: 1, Clients: "9091", SenderIp: "9091"},
+				{NodeId: 5, Version: 3, ParentId: 2, Clients: "9091,9092", SenderIp: "9091"},
+			},
+		})
+		corrupt := withDigests(snapshot)
+		corrupt.MetadataList = append([]Metadata(nil), snapshot.MetadataList...)
+		corrupt.MetadataList[2].Clients = "9091"
+		if err := zt.RestoreSnapshot(corrupt); err == nil {
+			t.Fatal("restored a snapshot not matching its digest")
+		}
+		// e.g. a truncated body decoded into an empty Snapshot
+		if err := zt.RestoreSnapshot(Snapshot{}); err == nil {
+			t.Fatal("restored a snapshot without root ZNode")
+		}
+		if metadatas, _ := zt.AllMetadata(); len(metadatas) != 2 {
+			t.Fatalf("got %d ZNode after a refused snapshot", len(metadatas))
+		}
+
+		err := zt.RestoreSnapshot(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report, _ := zt.Verify(); !report.OK() {
+			t.Fatal(report.String())
+		}
+
+		metadatas, _ := zt.AllMetadata()
+		expectIds(t, nodeIds(metadatas), []int{1, 2, 5})
+		purgedZxid, _ := zt.GetPurgedZxid()
+		if purgedZxid != 4 {
+			t.Fatalf("got PurgedZxid %d", purgedZxid)
+		}
+		if history, _ := zt.GetHistory("9090"); len(history) != 0 {
+			t.Fatalf("kept %d ZNode replaced by the Snapshot", len(history))
+		}
+
+		write(t, zt, "9091", "9091,9093", "2024-01-01T10:01:00Z")
+		highest, _ := zt.GetHighestZNodeId()
+		if highest != 6 {
+			t.Fatalf("highest ZNodeId %d", highest)
+		}
+	})
+}
+
+// withDigests of a Snapshot as if it was taken from a ZTree
+func withDigests(snapshot Snapshot) Snapshot {
+	snapshot.Digests = make(map[int]uint64)
+	digest := snapshot.PurgedDigest
+	for _, metadata := range snapshot.MetadataList {
+		digest += zNodeHash(metadata)
+		snapshot.Digests[metadata.NodeId] = digest
+	}
+	return snapshot
+}
+
+func TestConformanceDigest(t *testing.T) {
+	// Every backend gets the same digest from the same writes
+	digests := make(map[string]TreeDigest)
+	for name, open := range backends {
+		zt := open(t)
+		write(t, zt, "9090", "9090", "2024-01-01T10:00:00Z")
+		write(t, zt, "9090", "9090,9091", "2024-01-01T10:01:00Z")
+		write(t, zt, "9090", "9090,9091,9092", "2024-01-01T10:02:00Z")
+
+		before, _ := zt.GetDigest()
+		purged, _ := zt.PurgeHistory(1, time.Now())
+		after, err := zt.GetDigest()
+		if err != nil || len(purged) != 1 || after.Digest != before.Digest || after.PurgedDigest == 0 {
+			t.Fatalf("%s: digest %+v before purging %v, %+v after: %v", name, before, purged, after, err)
+		}
+		if report, _ := zt.Verify(); !report.OK() {
+			t.Fatalf("%s: %s", name, report.String())
+		}
+		digests[name] = after
+
+		snapshot, _ := zt.GetSnapshot()
+		if snapshot.Digests[after.Zxid] != after.Digest || snapshot.PurgedDigest != after.PurgedDigest {
+			t.Fatalf("%s: snapshot without the digest", name)
+		}
+	}
+	if digests["sqlite"] != digests["memory"] || digests["memory"] != digests["txnlog"] {
+		t.Fatalf("got different digests %+v", digests)
+	}
+}
+
+func TestMemoryTreeConcurrentWrites(t *testing.T) {
+	mt := NewMemoryTree()
+	mt.InitializeDB()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			senderIp := fmt.Sprintf("90%02d", i)
+			for j := 0; j < 20; j++ {
+				_, err := mt.InsertMetadataWithParent(Metadata{Clients: fmt.Sprintf("%s,%d", senderIp, j), SenderIp: senderIp})
+				if err != nil {
+					t.Error(err)
+				}
+				mt.GetClients(senderIp)
+				mt.AllMetadata()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	highest, _ := mt.GetHighestZNodeId()
+	if highest != 1+10*20 {
+		t.Fatalf("highest ZNodeId %d", highest)
+	}
+	for i := 0; i < 10; i++ {
+		history, _ := mt.GetHistory(fmt.Sprintf("90%02d", i))
+		if len(history) != 20 || history[19].Version != 19 {
+			t.Fatalf("got %d versions", len(history))
+		}
+	}
+}
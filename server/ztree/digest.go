@@ -0,0 +1,131 @@
+package ztree
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// TreeDigest of a ZTree: the sum of the hashes of every ZNode ever committed up to Zxid, so it only depends on the
+// committed Transaction and not on their order. Purging a version moves its hash to PurgedDigest, leaving Digest as is.
+// (Ref: https://zookeeper.apache.org/doc/current/zookeeperAdmin.html#sc_digest)
+type TreeDigest struct {
+	Zxid         int    `json:"zxid"`
+	Digest       uint64 `json:"digest"`
+	PurgedDigest uint64 `json:"purgedDigest"`
+}
+
+// VerifyReport of the integrity of a ZTree, corrupt if it has any problem
+type VerifyReport struct {
+	Zxid     int      `json:"zxid"`
+	ZNodes   int      `json:"zNodes"`
+	Digest   uint64   `json:"digest"`
+	Problems []string `json:"problems,omitempty"`
+	// Warnings of what was recovered from, not a corruption
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *VerifyReport) String() string {
+	report := fmt.Sprintf("%d ZNode up to zxid %d, digest %016x", r.ZNodes, r.Zxid, r.Digest)
+	if r.OK() {
+		report += ": OK"
+	} else {
+		report += fmt.Sprintf(": %d problem(s)\n  - %s", len(r.Problems), strings.Join(r.Problems, "\n  - "))
+	}
+	for _, warning := range r.Warnings {
+		report += "\n  warning: " + warning
+	}
+	return report
+}
+
+// zNodeHash of the replicated content of a ZNode, its checksum and its part of the TreeDigest
+func zNodeHash(metadata Metadata) uint64 {
+	fields := []string{
+		strconv.Itoa(metadata.NodeId), metadata.NodePort, metadata.Leader, metadata.Servers,
+		canonicalTimestamp(metadata.Timestamp), strconv.Itoa(metadata.Version), strconv.Itoa(metadata.ParentId),
+		metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(fields, "\x00")))
+	return h.Sum64()
+}
+
+// canonicalTimestamp as read back from the DATETIME column of the SQLite ZTree, so every backend hashes the same
+// Timestamp: formatted as RFC 3339 in UTC, empty if it is not a valid time
+func canonicalTimestamp(timestamp string) string {
+	timestamp = strings.TrimSuffix(timestamp, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, timestamp, time.UTC); err == nil {
+			if t.IsZero() {
+				return ""
+			}
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return ""
+}
+
+// verifyNodes sorted by NodeId against the TreeDigest and the Digest at the highest zxid, and their hierarchy
+func verifyNodes(report *VerifyReport, nodes []Metadata, treeDigest TreeDigest, highestDigest uint64) {
+	report.ZNodes = len(nodes)
+	report.Zxid = treeDigest.Zxid
+	report.Digest = treeDigest.Digest
+
+	sum := treeDigest.PurgedDigest
+	exists := make(map[int]bool)
+	for _, node := range nodes {
+		sum += zNodeHash(node)
+		exists[node.NodeId] = true
+	}
+	if len(nodes) > 0 && nodes[0].NodeId != 1 {
+		report.problem("root ZNode 1 is missing")
+	}
+	for _, node := range nodes {
+		if node.ParentId != 0 && !exists[node.ParentId] {
+			report.problem("ZNode %d has a missing parent ZNode %d", node.NodeId, node.ParentId)
+		}
+	}
+	if sum != treeDigest.Digest {
+		report.problem("tree digest %016x does not match the ZNode it holds (%016x), some were changed, added or deleted", treeDigest.Digest, sum)
+	}
+	if len(nodes) > 0 && highestDigest != treeDigest.Digest {
+		report.problem("digest at zxid %d is %016x instead of the tree digest %016x", treeDigest.Zxid, highestDigest, treeDigest.Digest)
+	}
+}
+
+// verify the Snapshot holds the root ZNode and matches its Digests before restoring it, returning the Digest of the
+// ZTree
+func (s Snapshot) verify() (uint64, error) {
+	sum := s.PurgedDigest
+	highest := 0
+	root := false
+	for _, metadata := range s.MetadataList {
+		sum += zNodeHash(metadata)
+		if metadata.NodeId > highest {
+			highest = metadata.NodeId
+		}
+		if metadata.NodeId == 1 {
+			root = true
+		}
+	}
+	if !root {
+		return 0, errors.New("snapshot has no root ZNode")
+	}
+	if highest > 0 && s.Digests[highest] != sum {
+		return 0, fmt.Errorf("snapshot digest %016x at zxid %d does not match its ZNode (%016x)", s.Digests[highest], highest, sum)
+	}
+	return sum, nil
+}
@@ -0,0 +1,77 @@
+package ztree
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalTimestamp(t *testing.T) {
+	for _, timestamp := range []string{"2024-01-01T10:00:00Z", "2024-01-01 10:00:00", "2024-01-01T12:00:00+02:00"} {
+		if got := canonicalTimestamp(timestamp); got != "2024-01-01T10:00:00Z" {
+			t.Fatalf("%q: got %q", timestamp, got)
+		}
+	}
+	for _, timestamp := range []string{"", "0001-01-01T00:00:00Z", "not a time"} {
+		if got := canonicalTimestamp(timestamp); got != "" {
+			t.Fatalf("%q: got %q", timestamp, got)
+		}
+	}
+}
+
+func TestVerifyCorruptSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zooweeper-metadata.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	zt := &ZTree{DB: db}
+	zt.InitializeDB()
+	write(t, zt, "9090", "9090", "2024-01-01T10:00:00Z")
+	write(t, zt, "9091", "9091", "2024-01-01T10:01:00Z")
+
+	report, err := VerifyFile(path)
+	if err != nil || !report.OK() || report.Zxid != 3 || report.ZNodes != 3 {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+
+	zt.DB.Exec("UPDATE ZNode SET Clients = '9090,9092' WHERE NodeId = 2")
+	zt.DB.Exec("DELETE FROM ZNode WHERE NodeId = 3")
+	report, err = VerifyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := strings.Join(report.Problems, "\n")
+	if !strings.Contains(problems, "ZNode 2 checksum") || !strings.Contains(problems, "tree digest") {
+		t.Fatalf("got %s", report.String())
+	}
+}
+
+func TestVerifyTxnLog(t *testing.T) {
+	dir := t.TempDir()
+	tt := NewTxnLogTree(dir, 3)
+	tt.InitializeDB()
+	for i := 0; i < 5; i++ {
+		write(t, tt, "9090", fmt.Sprintf("9090,%d", i), "")
+	}
+	crash(tt)
+
+	// A torn record is reported without truncating the log
+	last := tt.path("log", tt.sequences("log")[len(tt.sequences("log"))-1])
+	logFile, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	logFile.Write([]byte{0, 0, 1})
+	logFile.Close()
+	before, _ := os.Stat(last)
+
+	report, err := VerifyFile(dir)
+	if err != nil || !report.OK() || report.Zxid != 6 || len(report.Warnings) != 1 {
+		t.Fatalf("got %s, %v", report.String(), err)
+	}
+	if after, _ := os.Stat(last); after.Size() != before.Size() {
+		t.Fatal("truncated the log")
+	}
+}
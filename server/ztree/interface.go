@@ -1,14 +1,13 @@
 // Package ztree implements the Replicated Database component for our ZooWeeper.
 //
-// 1. Instead of using the filesystem, we implemented the data model and hierarchical namespace using sqlite
+// 1. Instead of using the filesystem, we implemented the data model and hierarchical namespace using sqlite, its
+// schema versioned in a SchemaVersion table and upgraded at startup by the migrations in migrations.go
 // - each row is a ZNode storing Metadata
 // - the field ParentId will represent the hierarchical relationship
 // 2. (Use-case specific) We only support Regular/Permanent ZNode, no Sequential or Ephemeral ZNode
 // 3. Metadata fields in ZNode:
-// - NodeId (int): similar to zxid, representing metadata transaction (1st NodeId is a self-identified by design)
-// - NodePort (string): the port of the current ZooWeeper server (808x by design)
-// - Leader (string): the port  of the current leader in the ensemble (highest NodePort by design)
-// - Servers (string): comma-separated list of the ports of all ZooWeeper servers in the ensemble
+// - NodeId (int): similar to zxid, representing metadata transaction (1st NodeId is the root ZNode, the same on every server)
+// - NodePort, Leader, Servers (string): always empty, the identity of a server is kept in LocalState instead
 // - Timestamp (string): timestamp at which this ZNode is created
 // - Version (int): keep track of ZNode changes, incremented when a Transaction modify metadata for Kafka cluster ("Clients" field below)
 // - ParentId (int): NodeId of parent ZNode
@@ -16,14 +15,43 @@
 // - SenderIp (string): (Use-case specific) the port of the client (Kafka-Server) that sent the Write Request
 // - ReceiverIp (string): (Use-case specific) the port of the ZooWeeper server that the client (Kafka-Server) chose to send the Write Request to
 //
+// 4. A separate LocalState table holds the identity of this server and its view of the ensemble, never replicated:
+// - NodePort (string): the server ID of the current ZooWeeper server (its port unless a CONFIG_FILE is used)
+// - Leader (string): the server ID of the current leader in the ensemble
+// - Servers (string): comma-separated list of the server IDs of all ZooWeeper servers in the ensemble, changed by Reconfig
+// - Observers (string): comma-separated list of the server IDs of the Observers among them
+//
+// 5. A separate RequestLog table remembers the result of the most recent client RequestId, so a retried Write Request
+// is not committed twice
+//
+// 6. Superseded versions of a process ZNode are purged by PurgeHistory according to the retention on the Leader, and
+// by PurgeZNodes with the same NodeId on the other servers. The highest purged NodeId is kept as PurgedZxid in a
+// Retention table: a Follower behind it is sent a whole Snapshot instead
+//
+// 7. Since a ZNode is never updated in place, GetHistory lists every version of a process ZNode not yet purged and
+// AllMetadataAsOf reads the ZTree as it was at a zxid
+//
+// 8. STORAGE_ENGINE=txnlog keeps the same data in memory instead, see TxnLogTree, made durable by an append-only
+// transaction log and periodic snapshots so every write costs one append whatever the size of the history.
+// STORAGE_ENGINE=memory keeps it in a MemoryTree only, for tests and ephemeral ensembles. conformance_test.go checks
+// every implementation behaves the same.
+//
+// 9. Every ZNode is stored with a Checksum, and the ZTree keeps a TreeDigest of all ZNode ever committed along with its
+// Digest at the zxid of each ZNode. InitializeDB refuses to start with a ZTree failing Verify, VerifyFile checks the
+// files of a stopped server. Replicas compare their Digest at the same zxid to detect a divergence.
+//
 // Reference: https://zookeeper.apache.org/doc/current/zookeeperOver.html
 
 package ztree
 
 import (
 	"database/sql"
+	"time"
 )
 
+// REQUEST_LOG_SIZE most recent client RequestId kept in the RequestLog
+const REQUEST_LOG_SIZE = 1000
+
 type ZTree struct {
 	DB *sql.DB
 }
@@ -32,18 +60,34 @@ type ZNodeHandlers interface {
 	// Utils
 	Connection() *sql.DB
 	InitializeDB()
+	Close() error
 
 	// Getter
 	AllMetadata() ([]*Metadata, error)
 	ZNodeIdExists(nodeId int) (bool, error)
 	GetHighestZNodeId() (int, error)
-	GetLocalMetadata() (*Metadata, error)
+	GetLocalState() (*LocalState, error)
 	GetMetadatasGreaterThanZNodeId(highestZNodeId int) (Metadatas, error)
 	GetClients(client string) ([]string, error)
+	GetRequestResult(requestId string) (string, bool, error)
+	GetRequestLog() ([]RequestEntry, error)
+	GetPurgedZxid() (int, error)
+	GetHistory(senderIp string) ([]Metadata, error)
+	AllMetadataAsOf(zxid int) ([]*Metadata, error)
+	GetZNodeIdAsOfTime(asOf time.Time) (int, error)
+	GetSnapshot() (Snapshot, error)
+	GetDigest() (TreeDigest, error)
+	GetDigestAt(zxid int) (uint64, bool, error)
+	Verify() (VerifyReport, error)
 
 	// Setter
-	InsertFirstMetadata(metadata Metadata) error
+	InitLocalState(state LocalState) error
+	UpdateLeader(leader string) error
+	UpdateEnsemble(servers, observers string) error
 	InsertMetadata(metadata Metadata) error
-	InsertMetadataWithParent(metadata Metadata) error
-	UpdateFirstLeader(Leader string) error
+	InsertMetadataWithParent(metadata Metadata) (int, error)
+	InsertRequestResult(requestId, result string) error
+	PurgeHistory(keepVersions int, before time.Time) ([]int, error)
+	PurgeZNodes(nodeIds []int) error
+	RestoreSnapshot(snapshot Snapshot) error
 }
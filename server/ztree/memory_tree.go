@@ -0,0 +1,483 @@
+package ztree
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryTree is a ZNodeHandlers keeping the ZTree in memory only, with the same semantics as the SQLite ZTree. On its
+// own, selected with STORAGE_ENGINE=memory, it suits tests and ephemeral ensembles as nothing survives a restart. The
+// TxnLogTree makes it durable through its journal.
+type MemoryTree struct {
+	nodes      []Metadata // sorted by NodeId
+	requests   map[string]string
+	requestIds []string // in insertion order, to only keep the most recent REQUEST_LOG_SIZE
+	local      *LocalState
+	purgedZxid int
+	mu         sync.RWMutex
+
+	// digest of the tree, purgedDigest of the purged ZNode within it, and digests at the zxid of each ZNode
+	digest       uint64
+	purgedDigest uint64
+	digests      map[int]uint64
+
+	// journal makes every change durable before it is applied, nil on its own
+	journal journal
+}
+
+// journal of a MemoryTree, called with mu held
+type journal interface {
+	append(record txnRecord) error
+	applied()
+	restored() error
+	saveLocalState(state LocalState) error
+}
+
+// txnRecord is one change to the ZTree
+type txnRecord struct {
+	Type      string    `json:"type"`
+	Metadata  *Metadata `json:"metadata,omitempty"`
+	RequestId string    `json:"requestId,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	NodeIds   []int     `json:"nodeIds,omitempty"`
+}
+
+const (
+	ZNODE_RECORD   = "znode"
+	REQUEST_RECORD = "request"
+	PURGE_RECORD   = "purge"
+)
+
+var errNoLocalState = errors.New("no LocalState")
+
+func NewMemoryTree() *MemoryTree {
+	return &MemoryTree{
+		requests: make(map[string]string),
+		digests:  make(map[int]uint64),
+	}
+}
+
+// Connection is nil, there is no database behind a MemoryTree
+func (mt *MemoryTree) Connection() *sql.DB {
+	return nil
+}
+
+// InitializeDB with the root ZNode, the same on every server
+func (mt *MemoryTree) InitializeDB() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, ok := mt.find(1); !ok {
+		mt.commit(txnRecord{Type: ZNODE_RECORD, Metadata: &Metadata{NodeId: 1}})
+	}
+}
+
+func (mt *MemoryTree) Close() error {
+	return nil
+}
+
+func (mt *MemoryTree) AllMetadata() ([]*Metadata, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var results []*Metadata
+	for i := range mt.nodes {
+		data := mt.nodes[i]
+		results = append(results, &data)
+	}
+	return results, nil
+}
+
+func (mt *MemoryTree) ZNodeIdExists(nodeId int) (bool, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	_, ok := mt.find(nodeId)
+	return ok, nil
+}
+
+func (mt *MemoryTree) GetHighestZNodeId() (int, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.highestZNodeId(), nil
+}
+
+func (mt *MemoryTree) GetMetadatasGreaterThanZNodeId(highestZNodeId int) (Metadatas, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var metadatas Metadatas
+	i := sort.Search(len(mt.nodes), func(i int) bool { return mt.nodes[i].NodeId > highestZNodeId })
+	for ; i < len(mt.nodes); i++ {
+		metadatas.MetadataList = append(metadatas.MetadataList, mt.nodes[i])
+	}
+	return metadatas, nil
+}
+
+// GetClients of the first ZNode of a client, same as the SQLite ZTree
+func (mt *MemoryTree) GetClients(client string) ([]string, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var clientsStr string
+	if i, ok := mt.parentNode(client); ok {
+		clientsStr = mt.nodes[i].Clients
+	}
+	return strings.Split(clientsStr, ","), nil
+}
+
+func (mt *MemoryTree) GetRequestResult(requestId string) (string, bool, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	result, ok := mt.requests[requestId]
+	return result, ok, nil
+}
+
+func (mt *MemoryTree) GetRequestLog() ([]RequestEntry, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.requestLog(), nil
+}
+
+func (mt *MemoryTree) GetPurgedZxid() (int, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.purgedZxid, nil
+}
+
+func (mt *MemoryTree) GetHistory(senderIp string) ([]Metadata, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var history []Metadata
+	for _, node := range mt.nodes {
+		if node.SenderIp == senderIp {
+			history = append(history, node)
+		}
+	}
+	return history, nil
+}
+
+func (mt *MemoryTree) AllMetadataAsOf(zxid int) ([]*Metadata, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var results []*Metadata
+	for i := range mt.nodes {
+		if mt.nodes[i].NodeId > zxid {
+			break
+		}
+		data := mt.nodes[i]
+		results = append(results, &data)
+	}
+	return results, nil
+}
+
+func (mt *MemoryTree) GetZNodeIdAsOfTime(asOf time.Time) (int, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return zNodeIdAsOfTime(mt.nodes, asOf), nil
+}
+
+func (mt *MemoryTree) GetLocalState() (*LocalState, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	if mt.local == nil {
+		return nil, errNoLocalState
+	}
+	state := *mt.local
+	return &state, nil
+}
+
+func (mt *MemoryTree) InitLocalState(state LocalState) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.local != nil {
+		return nil
+	}
+	return mt.setLocalState(state)
+}
+
+func (mt *MemoryTree) UpdateLeader(leader string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.local == nil {
+		return errNoLocalState
+	}
+	state := *mt.local
+	state.Leader = leader
+	return mt.setLocalState(state)
+}
+
+func (mt *MemoryTree) UpdateEnsemble(servers, observers string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.local == nil {
+		return errNoLocalState
+	}
+	state := *mt.local
+	state.Servers = servers
+	state.Observers = observers
+	return mt.setLocalState(state)
+}
+
+func (mt *MemoryTree) InsertMetadata(metadata Metadata) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, ok := mt.find(metadata.NodeId); ok {
+		return fmt.Errorf("ZNode %d already exists", metadata.NodeId)
+	}
+	return mt.commit(txnRecord{Type: ZNODE_RECORD, Metadata: &metadata})
+}
+
+// InsertMetadataWithParent with the same ZNode hierarchy as the SQLite ZTree: the first ZNode of a client is a direct
+// child of the root, later ones are children of it with an incremented Version whenever its Clients change
+func (mt *MemoryTree) InsertMetadataWithParent(metadata Metadata) (int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	zNode := Metadata{
+		NodeId:     mt.highestZNodeId() + 1,
+		Timestamp:  metadata.Timestamp,
+		Clients:    metadata.Clients,
+		SenderIp:   metadata.SenderIp,
+		ReceiverIp: metadata.ReceiverIp,
+	}
+
+	parent, ok := mt.parentNode(metadata.SenderIp)
+	if !ok {
+		zNode.ParentId = 1
+	} else {
+		latest := mt.latestNode(metadata.SenderIp)
+		if mt.nodes[latest].Clients == metadata.Clients {
+			return mt.nodes[latest].NodeId, nil
+		}
+		zNode.ParentId = mt.nodes[parent].NodeId
+		zNode.Version = mt.nodes[latest].Version + 1
+	}
+	err := mt.commit(txnRecord{Type: ZNODE_RECORD, Metadata: &zNode})
+	if err != nil {
+		return 0, err
+	}
+	return zNode.NodeId, nil
+}
+
+func (mt *MemoryTree) InsertRequestResult(requestId, result string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.commit(txnRecord{Type: REQUEST_RECORD, RequestId: requestId, Result: result})
+}
+
+func (mt *MemoryTree) PurgeHistory(keepVersions int, before time.Time) ([]int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	purged := supersededVersions(mt.nodes, keepVersions, before)
+	if len(purged) == 0 {
+		return nil, nil
+	}
+	err := mt.commit(txnRecord{Type: PURGE_RECORD, NodeIds: purged})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+func (mt *MemoryTree) PurgeZNodes(nodeIds []int) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if len(nodeIds) == 0 {
+		return nil
+	}
+	return mt.commit(txnRecord{Type: PURGE_RECORD, NodeIds: nodeIds})
+}
+
+func (mt *MemoryTree) RestoreSnapshot(snapshot Snapshot) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	err := mt.load(snapshot)
+	if err != nil {
+		return err
+	}
+	if mt.journal != nil {
+		return mt.journal.restored()
+	}
+	return nil
+}
+
+func (mt *MemoryTree) GetSnapshot() (Snapshot, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.snapshot(), nil
+}
+
+func (mt *MemoryTree) GetDigest() (TreeDigest, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return TreeDigest{Zxid: mt.highestZNodeId(), Digest: mt.digest, PurgedDigest: mt.purgedDigest}, nil
+}
+
+func (mt *MemoryTree) GetDigestAt(zxid int) (uint64, bool, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	digest, ok := mt.digests[zxid]
+	return digest, ok, nil
+}
+
+// Verify the digest of the tree, each ZNode is only hashed once applied so there is no checksum of its own to check
+func (mt *MemoryTree) Verify() (VerifyReport, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var report VerifyReport
+	treeDigest := TreeDigest{Zxid: mt.highestZNodeId(), Digest: mt.digest, PurgedDigest: mt.purgedDigest}
+	for _, node := range mt.nodes {
+		if _, ok := mt.digests[node.NodeId]; !ok {
+			report.problem("ZNode %d has no digest", node.NodeId)
+		}
+	}
+	verifyNodes(&report, mt.nodes, treeDigest, mt.digests[treeDigest.Zxid])
+	return report, nil
+}
+
+// snapshot of the ZNode with their digests. Callers hold mu.
+func (mt *MemoryTree) snapshot() Snapshot {
+	snapshot := Snapshot{
+		PurgedZxid:   mt.purgedZxid,
+		PurgedDigest: mt.purgedDigest,
+		MetadataList: append([]Metadata(nil), mt.nodes...),
+		Digests:      make(map[int]uint64, len(mt.digests)),
+	}
+	for nodeId, digest := range mt.digests {
+		snapshot.Digests[nodeId] = digest
+	}
+	return snapshot
+}
+
+// load the ZNode of a Snapshot once its digest is verified. Callers hold mu.
+func (mt *MemoryTree) load(snapshot Snapshot) error {
+	digest, err := snapshot.verify()
+	if err != nil {
+		return err
+	}
+	mt.nodes = append([]Metadata(nil), snapshot.MetadataList...)
+	sort.Slice(mt.nodes, func(i, j int) bool { return mt.nodes[i].NodeId < mt.nodes[j].NodeId })
+	mt.purgedZxid = snapshot.PurgedZxid
+	mt.digest = digest
+	mt.purgedDigest = snapshot.PurgedDigest
+	mt.digests = make(map[int]uint64, len(mt.nodes))
+	for _, node := range mt.nodes {
+		mt.digests[node.NodeId] = snapshot.Digests[node.NodeId]
+	}
+	return nil
+}
+
+// commit a change, once durable in the journal if any. Callers hold mu.
+func (mt *MemoryTree) commit(record txnRecord) error {
+	if mt.journal != nil {
+		if err := mt.journal.append(record); err != nil {
+			return err
+		}
+	}
+	mt.apply(record)
+	if mt.journal != nil {
+		mt.journal.applied()
+	}
+	return nil
+}
+
+// apply a change, idempotent so replaying a record twice is harmless
+func (mt *MemoryTree) apply(record txnRecord) {
+	switch record.Type {
+	case ZNODE_RECORD:
+		metadata := *record.Metadata
+		mt.digest += zNodeHash(metadata)
+		i, ok := mt.find(metadata.NodeId)
+		if ok {
+			mt.digest -= zNodeHash(mt.nodes[i])
+			mt.nodes[i] = metadata
+		} else {
+			mt.nodes = append(mt.nodes, Metadata{})
+			copy(mt.nodes[i+1:], mt.nodes[i:])
+			mt.nodes[i] = metadata
+		}
+		mt.digests[metadata.NodeId] = mt.digest
+	case PURGE_RECORD:
+		for _, nodeId := range record.NodeIds {
+			if i, ok := mt.find(nodeId); ok {
+				// Its hash moves to the purgedDigest, leaving the digest as is
+				mt.purgedDigest += zNodeHash(mt.nodes[i])
+				delete(mt.digests, nodeId)
+				mt.nodes = append(mt.nodes[:i], mt.nodes[i+1:]...)
+			}
+			if nodeId > mt.purgedZxid {
+				mt.purgedZxid = nodeId
+			}
+		}
+	case REQUEST_RECORD:
+		if _, ok := mt.requests[record.RequestId]; !ok {
+			mt.requestIds = append(mt.requestIds, record.RequestId)
+		}
+		mt.requests[record.RequestId] = record.Result
+		for len(mt.requestIds) > REQUEST_LOG_SIZE {
+			delete(mt.requests, mt.requestIds[0])
+			mt.requestIds = mt.requestIds[1:]
+		}
+	}
+}
+
+// requestLog from the oldest to the most recent RequestId. Callers hold mu.
+func (mt *MemoryTree) requestLog() []RequestEntry {
+	var entries []RequestEntry
+	for _, requestId := range mt.requestIds {
+		entries = append(entries, RequestEntry{RequestId: requestId, Result: mt.requests[requestId]})
+	}
+	return entries
+}
+
+// setLocalState, once saved by the journal if any. Callers hold mu.
+func (mt *MemoryTree) setLocalState(state LocalState) error {
+	if mt.journal != nil {
+		if err := mt.journal.saveLocalState(state); err != nil {
+			return err
+		}
+	}
+	mt.local = &state
+	return nil
+}
+
+func (mt *MemoryTree) find(nodeId int) (int, bool) {
+	i := sort.Search(len(mt.nodes), func(i int) bool { return mt.nodes[i].NodeId >= nodeId })
+	return i, i < len(mt.nodes) && mt.nodes[i].NodeId == nodeId
+}
+
+func (mt *MemoryTree) highestZNodeId() int {
+	if len(mt.nodes) == 0 {
+		return 0
+	}
+	return mt.nodes[len(mt.nodes)-1].NodeId
+}
+
+// parentNode is the first ZNode of a client
+func (mt *MemoryTree) parentNode(senderIp string) (int, bool) {
+	for i := range mt.nodes {
+		if mt.nodes[i].SenderIp == senderIp {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// latestNode is the last ZNode of a client, only called once parentNode found one
+func (mt *MemoryTree) latestNode(senderIp string) int {
+	for i := len(mt.nodes) - 1; i >= 0; i-- {
+		if mt.nodes[i].SenderIp == senderIp {
+			return i
+		}
+	}
+	return 0
+}
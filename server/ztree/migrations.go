@@ -0,0 +1,203 @@
+package ztree
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration of the SQLite schema, each one applied once in order of Version within a transaction recording it in the
+// SchemaVersion table. Statements stay idempotent, as databases older than SchemaVersion already have some tables.
+// Apply, if any, runs after them for changes SQL alone cannot make.
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+	Apply      func(tx *sql.Tx) error
+}
+
+// migrations of the schema, only ever append a new one with the next Version
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create ZNode and RequestLog",
+		Statements: []string{`
+	CREATE TABLE IF NOT EXISTS ZNode (
+		NodeId INTEGER PRIMARY KEY AUTOINCREMENT,
+		NodePort TEXT,
+		Leader TEXT,
+		Servers TEXT,
+		Timestamp DATETIME,
+		Version INTEGER,
+		ParentId INTEGER,
+		Clients TEXT,
+		SenderIp TEXT,
+		ReceiverIp TEXT
+);`, `
+	CREATE TABLE IF NOT EXISTS RequestLog (
+		RequestId TEXT PRIMARY KEY,
+		Result TEXT
+);`,
+		},
+	},
+	{
+		// Root ZNode with NodeId 1, the same on every server so NodeId stays a replicated zxid. Older databases kept
+		// the identity of the server in it, which is moved to LocalState.
+		Version: 2,
+		Name:    "move the server identity from the root ZNode to LocalState",
+		Statements: []string{`
+	CREATE TABLE IF NOT EXISTS LocalState (
+		Id INTEGER PRIMARY KEY CHECK (Id = 1),
+		NodePort TEXT,
+		Leader TEXT,
+		Servers TEXT,
+		Observers TEXT
+);`, `
+	INSERT INTO LocalState (Id, NodePort, Leader, Servers, Observers)
+	SELECT 1, NodePort, Leader, Servers, '' FROM ZNode WHERE NodeId = 1 AND NodePort != ''
+	ON CONFLICT (Id) DO NOTHING;`, `
+	INSERT INTO ZNode (NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp)
+	VALUES (1, '', '', '', '', 0, 0, '', '', '')
+	ON CONFLICT (NodeId) DO UPDATE SET NodePort = '', Leader = '', Servers = '';`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create Retention",
+		Statements: []string{`
+	CREATE TABLE IF NOT EXISTS Retention (
+		Id INTEGER PRIMARY KEY CHECK (Id = 1),
+		PurgedZxid INTEGER
+);`, `
+	INSERT OR IGNORE INTO Retention (Id, PurgedZxid) VALUES (1, 0);`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add ZNode checksums and the TreeDigest",
+		Statements: []string{`
+	CREATE TABLE IF NOT EXISTS TreeDigest (
+		Id INTEGER PRIMARY KEY CHECK (Id = 1),
+		Digest INTEGER,
+		PurgedDigest INTEGER
+);`,
+		},
+		Apply: backfillDigests,
+	},
+}
+
+// backfillDigests of the existing ZNode, the versions already purged are unknown so they are left out of the TreeDigest
+func backfillDigests(tx *sql.Tx) error {
+	for _, column := range []string{"Checksum", "Digest"} {
+		err := addColumn(tx, "ZNode", column, "INTEGER")
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT " + zNodeColumns + " FROM ZNode ORDER BY NodeId")
+	if err != nil {
+		return err
+	}
+	nodes, err := scanMetadatas(rows)
+	if err != nil {
+		return err
+	}
+
+	var digest uint64
+	for _, node := range nodes {
+		checksum := zNodeHash(node)
+		digest += checksum
+		_, err = tx.Exec("UPDATE ZNode SET Checksum = ?, Digest = ? WHERE NodeId = ?", int64(checksum), int64(digest), node.NodeId)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO TreeDigest (Id, Digest, PurgedDigest) VALUES (1, ?, 0)", int64(digest))
+	return err
+}
+
+// addColumn unless the table already has it
+func addColumn(tx *sql.Tx, table, column, columnType string) error {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+	return err
+}
+
+// SchemaVersion of the database, 0 before any migration
+func (zt *ZTree) SchemaVersion() (int, error) {
+	_, err := zt.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS SchemaVersion (
+		Version INTEGER PRIMARY KEY,
+		Name TEXT,
+		AppliedAt TEXT
+);`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = zt.DB.QueryRow("SELECT MAX(Version) FROM SchemaVersion").Scan(&version)
+	return int(version.Int64), err
+}
+
+// latestSchemaVersion supported by this ZooWeeper
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate the database to the latest schema, refusing a database from a newer ZooWeeper
+func (zt *ZTree) Migrate() error {
+	current, err := zt.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than %d supported by this ZooWeeper, upgrade it", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("Migrating schema to version %d: %s", m.Version, m.Name)
+		err := zt.applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (zt *ZTree) applyMigration(m migration) error {
+	tx, err := zt.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.Statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	if m.Apply != nil {
+		err = m.Apply(tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO SchemaVersion (Version, Name, AppliedAt) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,86 @@
+package ztree
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openSQLite(t *testing.T) *ZTree {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "zooweeper-metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &ZTree{DB: db}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	zt := openSQLite(t)
+	for i := 0; i < 2; i++ {
+		if err := zt.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, _ := zt.SchemaVersion()
+	if version != migrations[len(migrations)-1].Version {
+		t.Fatalf("got schema version %d", version)
+	}
+	var count int
+	zt.DB.QueryRow("SELECT COUNT(*) FROM SchemaVersion").Scan(&count)
+	if count != len(migrations) {
+		t.Fatalf("recorded %d migrations", count)
+	}
+}
+
+func TestMigrateDatabaseWithoutSchemaVersion(t *testing.T) {
+	zt := openSQLite(t)
+	// Database of a ZooWeeper keeping its identity in the root ZNode, before SchemaVersion
+	for _, statement := range migrations[0].Statements {
+		if _, err := zt.DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := zt.DB.Exec(`
+	INSERT INTO ZNode (NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp)
+	VALUES (1, '8080', '8082', '8080,8081,8082', '', 0, 0, '', '', ''), (2, '', '', '', '', 0, 1, '9090', '9090', '8080');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zt.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := zt.GetLocalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.NodePort != "8080" || local.Leader != "8082" || local.Servers != "8080,8081,8082" {
+		t.Fatalf("got LocalState %+v", *local)
+	}
+	metadatas, _ := zt.AllMetadata()
+	if len(metadatas) != 2 || metadatas[0].NodePort != "" || metadatas[1].Clients != "9090" {
+		t.Fatalf("got %d ZNode, root %+v", len(metadatas), *metadatas[0])
+	}
+	if report, _ := zt.Verify(); !report.OK() {
+		t.Fatal("checksums not backfilled: ", report.String())
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	zt := openSQLite(t)
+	if err := zt.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := zt.DB.Exec("INSERT INTO SchemaVersion (Version, Name) VALUES (?, 'from the future')", len(migrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = zt.Migrate()
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("got %v", err)
+	}
+}
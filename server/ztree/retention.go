@@ -0,0 +1,73 @@
+package ztree
+
+import (
+	"sort"
+	"time"
+)
+
+// zNodeIdAsOfTime is the highest NodeId written at or before asOf, given ZNode sorted by NodeId. The root is always
+// there and ZNode without a valid Timestamp are skipped.
+func zNodeIdAsOfTime(nodes []Metadata, asOf time.Time) int {
+	zxid := 0
+	for _, node := range nodes {
+		if node.NodeId == 1 {
+			zxid = 1
+			continue
+		}
+		written, err := time.Parse(time.RFC3339Nano, node.Timestamp)
+		if err != nil {
+			continue
+		}
+		if written.After(asOf) {
+			break
+		}
+		zxid = node.NodeId
+	}
+	return zxid
+}
+
+// supersededVersions of every process ZNode to purge, given ZNode sorted by NodeId. A version is kept while it is one of
+// the last keepVersions of its process or written after before, a zero value disabling that rule. The root, the
+// process ZNode itself and its latest version are always kept.
+func supersededVersions(nodes []Metadata, keepVersions int, before time.Time) []int {
+	if keepVersions <= 0 && before.IsZero() {
+		return nil
+	}
+
+	versions := make(map[string][]Metadata)
+	var senders []string
+	for _, node := range nodes {
+		if node.NodeId == 1 {
+			continue
+		}
+		if _, ok := versions[node.SenderIp]; !ok {
+			// First ZNode of a client is its process ZNode, the parent of its versions
+			versions[node.SenderIp] = []Metadata{}
+			senders = append(senders, node.SenderIp)
+			continue
+		}
+		versions[node.SenderIp] = append(versions[node.SenderIp], node)
+	}
+
+	var purged []int
+	for _, sender := range senders {
+		history := versions[sender]
+		for i, node := range history {
+			if i == len(history)-1 {
+				break
+			}
+			if keepVersions > 0 && i >= len(history)-keepVersions {
+				continue
+			}
+			if !before.IsZero() {
+				written, err := time.Parse(time.RFC3339Nano, node.Timestamp)
+				if err != nil || !written.Before(before) {
+					continue
+				}
+			}
+			purged = append(purged, node.NodeId)
+		}
+	}
+	sort.Ints(purged)
+	return purged
+}
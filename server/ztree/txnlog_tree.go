@@ -0,0 +1,437 @@
+package ztree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TxnLogTree keeps the ZTree in a MemoryTree, made durable by an append-only transaction log and periodic snapshots, an
+// alternative to the SQLite ZTree selected with STORAGE_ENGINE=txnlog
+// (Ref: https://zookeeper.apache.org/doc/current/zookeeperInternals.html#sc_logging)
+//
+// - log.<n>: every change is appended as a record framed with its length and CRC32, and fsynced before returning
+// - snapshot.<n>: the whole tree once all records of log.<m> with m < n are applied, written in the background from a
+// copy so writes go on in log.<n> meanwhile. Only the 2 most recent snapshots and the logs they need are kept.
+// - localstate.json: the LocalState, never part of the log as it is not replicated
+//
+// Recovery loads the most recent valid snapshot and replays the logs from the same sequence, a torn record at the end
+// of the last log, from a crash during an append, is truncated.
+type TxnLogTree struct {
+	*MemoryTree
+
+	Dir string
+	// SnapshotCount records appended to a log before it is rotated and a snapshot taken
+	SnapshotCount int
+
+	logFile      *os.File
+	logSeq       int
+	logCount     int
+	snapshotting bool
+
+	// readOnly to recover without truncating a torn record, see VerifyFile
+	readOnly bool
+	// warnings of the recovery, e.g. a skipped snapshot or a truncated torn record
+	warnings []string
+}
+
+// txnSnapshot of the whole tree, prefixed by its CRC32 on disk
+type txnSnapshot struct {
+	PurgedZxid   int            `json:"purgedZxid"`
+	PurgedDigest uint64         `json:"purgedDigest"`
+	Nodes        []Metadata     `json:"nodes"`
+	Digests      map[int]uint64 `json:"digests"`
+	Requests     []RequestEntry `json:"requests"`
+}
+
+func NewTxnLogTree(dir string, snapshotCount int) *TxnLogTree {
+	tt := &TxnLogTree{
+		MemoryTree:    NewMemoryTree(),
+		Dir:           dir,
+		SnapshotCount: snapshotCount,
+	}
+	tt.journal = tt
+	return tt
+}
+
+// InitializeDB recovers the tree from the latest snapshot and the log tail, then opens a new log
+func (tt *TxnLogTree) InitializeDB() {
+	log.Println("Recovering ZTree from", tt.Dir)
+	err := os.MkdirAll(tt.Dir, 0755)
+	if err != nil {
+		log.Fatal("InitializeDB: ", err)
+	}
+
+	err = tt.recover()
+	if err != nil {
+		log.Fatal("InitializeDB: ", err)
+	}
+	report, _ := tt.Verify()
+	if !report.OK() {
+		log.Fatal("InitializeDB: corrupt ZTree, restore it from a replica: ", report.String())
+	}
+	err = tt.loadLocalState()
+	if err != nil {
+		log.Fatal("InitializeDB: ", err)
+	}
+
+	tt.mu.Lock()
+	err = tt.openLog(tt.logSeq + 1)
+	tt.mu.Unlock()
+	if err != nil {
+		log.Fatal("InitializeDB: ", err)
+	}
+	tt.MemoryTree.InitializeDB()
+}
+
+// Close with a last snapshot, so the next start has no log to replay
+func (tt *TxnLogTree) Close() error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	seq, snapshot := tt.rotate()
+	err := tt.writeSnapshot(seq, snapshot)
+	if err != nil {
+		return err
+	}
+	return tt.logFile.Close()
+}
+
+// append a record to the log, write-ahead: the MemoryTree only applies it once durable
+func (tt *TxnLogTree) append(record txnRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[8:], payload)
+
+	_, err = tt.logFile.Write(frame)
+	if err != nil {
+		log.Println("Error appending to transaction log:", err)
+		return err
+	}
+	err = tt.logFile.Sync()
+	if err != nil {
+		log.Println("Error syncing transaction log:", err)
+		return err
+	}
+	return nil
+}
+
+// applied a record, taking a snapshot in the background once the log holds SnapshotCount records
+func (tt *TxnLogTree) applied() {
+	tt.logCount++
+	if tt.logCount < tt.SnapshotCount || tt.snapshotting {
+		return
+	}
+
+	tt.snapshotting = true
+	seq, snapshot := tt.rotate()
+	go func() {
+		err := tt.writeSnapshot(seq, snapshot)
+		if err != nil {
+			log.Println("Error writing snapshot:", err)
+		}
+		tt.mu.Lock()
+		tt.snapshotting = false
+		tt.mu.Unlock()
+	}()
+}
+
+// restored a Snapshot of the Leader, written at once as a snapshot of our own so recovery never replays the logs
+// before it
+func (tt *TxnLogTree) restored() error {
+	seq, snapshot := tt.rotate()
+	return tt.writeSnapshot(seq, snapshot)
+}
+
+func (tt *TxnLogTree) saveLocalState(state LocalState) error {
+	content, _ := json.Marshal(state)
+	return writeFileAtomic(filepath.Join(tt.Dir, "localstate.json"), content)
+}
+
+// rotate to a new log and copy the tree for a snapshot of everything before it. Callers hold mu.
+func (tt *TxnLogTree) rotate() (int, txnSnapshot) {
+	tree := tt.snapshot()
+	snapshot := txnSnapshot{
+		PurgedZxid:   tree.PurgedZxid,
+		PurgedDigest: tree.PurgedDigest,
+		Nodes:        tree.MetadataList,
+		Digests:      tree.Digests,
+		Requests:     tt.requestLog(),
+	}
+
+	seq := tt.logSeq + 1
+	tt.logFile.Close()
+	err := tt.openLog(seq)
+	if err != nil {
+		log.Fatal("Error rotating transaction log: ", err)
+	}
+	return seq, snapshot
+}
+
+func (tt *TxnLogTree) openLog(seq int) error {
+	logFile, err := os.OpenFile(tt.path("log", seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	tt.logFile = logFile
+	tt.logSeq = seq
+	tt.logCount = 0
+	return nil
+}
+
+// writeSnapshot durably, then purge the snapshots and logs no longer needed
+func (tt *TxnLogTree) writeSnapshot(seq int, snapshot txnSnapshot) error {
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	content := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(content[0:4], crc32.ChecksumIEEE(payload))
+	copy(content[4:], payload)
+
+	err = writeFileAtomic(tt.path("snapshot", seq), content)
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot %d with %d ZNode", seq, len(snapshot.Nodes))
+	tt.purge()
+	return nil
+}
+
+// purge all but the 2 most recent snapshots, and the logs before the oldest one kept
+func (tt *TxnLogTree) purge() {
+	snapshots := tt.sequences("snapshot")
+	if len(snapshots) <= 2 {
+		return
+	}
+	oldest := snapshots[len(snapshots)-2]
+	for _, seq := range snapshots[:len(snapshots)-2] {
+		os.Remove(tt.path("snapshot", seq))
+	}
+	for _, seq := range tt.sequences("log") {
+		if seq < oldest {
+			os.Remove(tt.path("log", seq))
+		}
+	}
+}
+
+// recover the tree from the most recent valid snapshot and the logs after it
+func (tt *TxnLogTree) recover() error {
+	start := 0
+	snapshots := tt.sequences("snapshot")
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot, err := readSnapshot(tt.path("snapshot", snapshots[i]))
+		if err == nil {
+			err = tt.load(snapshot.tree())
+		}
+		if err != nil {
+			tt.warn("skipping snapshot %d: %s", snapshots[i], err)
+			continue
+		}
+		for _, entry := range snapshot.Requests {
+			tt.apply(txnRecord{Type: REQUEST_RECORD, RequestId: entry.RequestId, Result: entry.Result})
+		}
+		start = snapshots[i]
+		tt.logSeq = start
+		log.Printf("Loaded snapshot %d with %d ZNode", start, len(snapshot.Nodes))
+		break
+	}
+
+	logs := tt.sequences("log")
+	if start == 0 && len(logs) > 0 && logs[0] > 1 {
+		return fmt.Errorf("log %d found without the snapshot before it", logs[0])
+	}
+	replayed := 0
+	for i, seq := range logs {
+		if seq < start {
+			continue
+		}
+		count, err := tt.replay(tt.path("log", seq), i == len(logs)-1)
+		if err != nil {
+			return err
+		}
+		replayed += count
+		tt.logSeq = seq
+	}
+	log.Printf("Replayed %d records, highest ZNodeId %d", replayed, tt.highestZNodeId())
+	return nil
+}
+
+// replay the records of a log, truncating a torn record at the end of the last log
+func (tt *TxnLogTree) replay(path string, last bool) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	offset := 0
+	reader := bufio.NewReader(bytes.NewReader(content))
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return count, nil
+		}
+
+		var payload []byte
+		if err == nil {
+			// A torn header may hold any length, never allocate more than the rest of the log
+			length := int64(binary.BigEndian.Uint32(header[0:4]))
+			if length > int64(len(content)-offset-8) {
+				err = io.ErrUnexpectedEOF
+			} else {
+				payload = make([]byte, length)
+				_, err = io.ReadFull(reader, payload)
+			}
+		}
+		if err == nil && crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			err = errors.New("checksum mismatch")
+		}
+		var record txnRecord
+		if err == nil {
+			err = json.Unmarshal(payload, &record)
+		}
+		if err != nil {
+			if !last {
+				return count, fmt.Errorf("corrupted record in %s at offset %d: %w", path, offset, err)
+			}
+			tt.warn("torn record in %s at offset %d: %s", path, offset, err)
+			if tt.readOnly {
+				return count, nil
+			}
+			log.Printf("Truncating %s at offset %d", path, offset)
+			return count, os.Truncate(path, int64(offset))
+		}
+
+		tt.apply(record)
+		count++
+		offset += 8 + len(payload)
+	}
+}
+
+// tree of a snapshot, snapshots written before digests were kept get the digests of their ZNode as if none was purged
+func (snapshot txnSnapshot) tree() Snapshot {
+	tree := Snapshot{
+		PurgedZxid:   snapshot.PurgedZxid,
+		PurgedDigest: snapshot.PurgedDigest,
+		MetadataList: snapshot.Nodes,
+		Digests:      snapshot.Digests,
+	}
+	if tree.Digests == nil {
+		tree.Digests = make(map[int]uint64)
+		var digest uint64
+		for _, metadata := range tree.MetadataList {
+			digest += zNodeHash(metadata)
+			tree.Digests[metadata.NodeId] = digest
+		}
+	}
+	return tree
+}
+
+func readSnapshot(path string) (txnSnapshot, error) {
+	var snapshot txnSnapshot
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+	if len(content) < 4 || crc32.ChecksumIEEE(content[4:]) != binary.BigEndian.Uint32(content[0:4]) {
+		return snapshot, errors.New("checksum mismatch")
+	}
+	err = json.Unmarshal(content[4:], &snapshot)
+	return snapshot, err
+}
+
+// warn of something recovered from, the tree is still consistent
+func (tt *TxnLogTree) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	log.Println("Recovery:", warning)
+	tt.warnings = append(tt.warnings, warning)
+}
+
+func (tt *TxnLogTree) loadLocalState() error {
+	content, err := os.ReadFile(filepath.Join(tt.Dir, "localstate.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state LocalState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return err
+	}
+	tt.local = &state
+	return nil
+}
+
+// sequences of the files with a prefix, e.g. log.1 and log.2, in increasing order
+func (tt *TxnLogTree) sequences(prefix string) []int {
+	entries, _ := os.ReadDir(tt.Dir)
+	var seqs []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix+".") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(name, prefix+"."))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+func (tt *TxnLogTree) path(prefix string, seq int) string {
+	return filepath.Join(tt.Dir, fmt.Sprintf("%s.%d", prefix, seq))
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
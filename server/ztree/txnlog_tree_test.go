@@ -0,0 +1,109 @@
+package ztree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeClients(t *testing.T, tt *TxnLogTree, clients string) {
+	t.Helper()
+	_, err := tt.InsertMetadataWithParent(Metadata{Clients: clients, SenderIp: "9090", ReceiverIp: "8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crash without the final snapshot of Close, once any background snapshot is written
+func crash(tt *TxnLogTree) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.logFile.Close()
+	for tt.snapshotting {
+		tt.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		tt.mu.Lock()
+	}
+}
+
+func expectNodeIds(t *testing.T, tt *TxnLogTree, want int) {
+	t.Helper()
+	metadatas, _ := tt.AllMetadata()
+	if len(metadatas) != want || metadatas[len(metadatas)-1].NodeId != want {
+		t.Fatalf("recovered %d ZNode, want %d", len(metadatas), want)
+	}
+}
+
+func TestTxnLogTreeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	tt := NewTxnLogTree(dir, 3)
+	tt.InitializeDB()
+	for i := 0; i < 7; i++ {
+		writeClients(t, tt, fmt.Sprintf("9090,%d", i))
+	}
+	tt.InsertRequestResult("a", "1")
+	crash(tt)
+
+	recovered := NewTxnLogTree(dir, 3)
+	recovered.InitializeDB()
+	defer recovered.Close()
+
+	expectNodeIds(t, recovered, 8)
+	if result, ok, _ := recovered.GetRequestResult("a"); !ok || result != "1" {
+		t.Fatal("lost RequestLog")
+	}
+}
+
+func TestTxnLogTreeTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	tt := NewTxnLogTree(dir, 1000)
+	tt.InitializeDB()
+	writeClients(t, tt, "9090")
+	writeClients(t, tt, "9090,9091")
+	crash(tt)
+
+	// A crash in the middle of an append, its header claiming far more than what was written
+	path := tt.path("log", tt.logSeq)
+	intact, _ := os.Stat(path)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], 0xFFFFFFF0)
+	logFile, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	logFile.Write(append(header, '{'))
+	logFile.Close()
+
+	recovered := NewTxnLogTree(dir, 1000)
+	recovered.InitializeDB()
+	expectNodeIds(t, recovered, 3)
+	if truncated, _ := os.Stat(path); truncated.Size() != intact.Size() {
+		t.Fatalf("log is %d bytes instead of %d", truncated.Size(), intact.Size())
+	}
+
+	// Later appends survive the next recovery
+	writeClients(t, recovered, "9090,9092")
+	crash(recovered)
+	again := NewTxnLogTree(dir, 1000)
+	again.InitializeDB()
+	defer again.Close()
+	expectNodeIds(t, again, 4)
+}
+
+func TestTxnLogTreeRefusesCorruptedRecordBeforeLastLog(t *testing.T) {
+	dir := t.TempDir()
+	tt := NewTxnLogTree(dir, 1000)
+	tt.InitializeDB()
+	writeClients(t, tt, "9090")
+	crash(tt)
+
+	path := tt.path("log", tt.logSeq)
+	content, _ := os.ReadFile(path)
+	content[len(content)-2] ^= 0xFF
+	os.WriteFile(path, content, 0644)
+	os.WriteFile(tt.path("log", tt.logSeq+1), nil, 0644)
+
+	recovered := NewTxnLogTree(dir, 1000)
+	if err := recovered.recover(); err == nil {
+		t.Fatal("replayed a corrupted record")
+	}
+}
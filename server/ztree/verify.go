@@ -0,0 +1,53 @@
+package ztree
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// VerifyFile of a stopped ZooWeeper server without changing it: a SQLite database, or the directory of a TxnLogTree
+func VerifyFile(path string) (VerifyReport, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	if info.IsDir() {
+		return verifyTxnLog(path)
+	}
+	return verifySQLite(path)
+}
+
+func verifyTxnLog(dir string) (VerifyReport, error) {
+	tt := NewTxnLogTree(dir, 0)
+	tt.readOnly = true
+	err := tt.recover()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	report, err := tt.Verify()
+	report.Warnings = tt.warnings
+	return report, err
+}
+
+func verifySQLite(path string) (VerifyReport, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer db.Close()
+
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(Version) FROM SchemaVersion").Scan(&version)
+	if err != nil {
+		return VerifyReport{}, fmt.Errorf("%s is not a ZooWeeper database: %w", path, err)
+	}
+	if int(version.Int64) != latestSchemaVersion() {
+		var report VerifyReport
+		report.problem("schema version %d instead of %d, start ZooWeeper once to migrate it", version.Int64, latestSchemaVersion())
+		return report, nil
+	}
+
+	zt := &ZTree{DB: db}
+	return zt.Verify()
+}
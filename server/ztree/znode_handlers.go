@@ -3,21 +3,37 @@ package ztree
 import (
 	"database/sql"
 	"log"
-	"strconv"
 	"strings"
+	"time"
 )
 
+// zNodeColumns of the Metadata, in the order of scanMetadatas
+const zNodeColumns = "NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp"
+
 func (zt *ZTree) AllMetadata() ([]*Metadata, error) {
-	rows, err := zt.DB.Query("SELECT * FROM ZNode")
+	rows, err := zt.DB.Query("SELECT " + zNodeColumns + " FROM ZNode ORDER BY NodeId")
 	if err != nil {
 		log.Println("Error querying the ztree:", err)
 		return nil, err
 	}
-	defer rows.Close()
+	nodes, err := scanMetadatas(rows)
+	if err != nil {
+		return nil, err
+	}
 
 	// collate all rows into one slice
 	var results []*Metadata
+	for i := range nodes {
+		results = append(results, &nodes[i])
+	}
+	return results, nil
+}
 
+// scanMetadatas of rows selecting zNodeColumns, then closed
+func scanMetadatas(rows *sql.Rows) ([]Metadata, error) {
+	defer rows.Close()
+
+	var nodes []Metadata
 	for rows.Next() {
 		var data Metadata
 		err := rows.Scan(
@@ -29,58 +45,24 @@ func (zt *ZTree) AllMetadata() ([]*Metadata, error) {
 			log.Println("Error scanning data", err)
 			return nil, err
 		}
-		results = append(results, &data)
+		nodes = append(nodes, data)
 	}
-
-	return results, nil
+	return nodes, rows.Err()
 }
 
-func (zt *ZTree) InsertFirstMetadata(metadata Metadata) error {
-	sqlStatement := `
-	INSERT INTO ZNode (NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
-`
-
-	row, err := zt.DB.Prepare(sqlStatement)
-	if err != nil {
-		log.Println("Error preparing row", err)
-		return err
-	}
-	defer row.Close()
-
-	_, err = row.Exec(
-		metadata.NodePort, metadata.Leader, metadata.Servers, metadata.Timestamp,
-		metadata.Version, 0,
-		metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
-	)
-	if err != nil {
-		log.Println("Error executing insert row", err)
-		return err
-	}
-
-	return nil
-}
-
-// InsertMetadataWithParent
-func (zt *ZTree) InsertMetadataWithParent(metadata Metadata) error {
+// InsertMetadataWithParent and return its NodeId, or the NodeId of the latest version if its Clients are unchanged
+func (zt *ZTree) InsertMetadataWithParent(metadata Metadata) (int, error) {
 	nodeId, _ := zt.getParentNodeId(metadata.SenderIp)
 
 	if nodeId == 0 {
 		// Insert parent process with parentId=1 (direct child of Zookeeper)
-		err := zt.insertParentProcessMetadata(metadata)
-		if err != nil {
-			return err
-		}
-	} else {
-		version, matched, _ := zt.checkSenderClientsMatch(metadata.SenderIp, metadata.Clients)
-		if !matched {
-			err := zt.updateProcessMetadata(metadata, nodeId, version+1)
-			if err != nil {
-				return err
-			}
-		}
+		return zt.insertParentProcessMetadata(metadata)
+	}
+	latest, version, matched, _ := zt.checkSenderClientsMatch(metadata.SenderIp, metadata.Clients)
+	if matched {
+		return latest, nil
 	}
-	return nil
+	return zt.updateProcessMetadata(metadata, nodeId, version+1)
 }
 
 func (zt *ZTree) GetClients(client string) ([]string, error) {
@@ -105,61 +87,118 @@ func (zt *ZTree) GetClients(client string) ([]string, error) {
 }
 
 func (zt *ZTree) InsertMetadata(metadata Metadata) error {
-	sqlInsert := `
-        INSERT INTO ZNode (NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `
-	_, err := zt.DB.Exec(sqlInsert, metadata.NodeId, metadata.NodePort, metadata.Leader, metadata.Servers, metadata.Timestamp, metadata.Version, metadata.ParentId, metadata.Clients, metadata.SenderIp, metadata.ReceiverIp)
+	_, err := zt.insertZNode(metadata)
 	return err
 }
 
-func (zt *ZTree) UpdateFirstLeader(leader string) error {
-	leaderNum, err := strconv.Atoi(leader)
+// insertZNode with its Checksum and the Digest of the ZTree once committed, in a single transaction. A ZNode without
+// NodeId gets the next one.
+func (zt *ZTree) insertZNode(metadata Metadata) (int, error) {
+	tx, err := zt.DB.Begin()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var nodeId interface{}
+	if metadata.NodeId != 0 {
+		nodeId = metadata.NodeId
+	}
+	result, err := tx.Exec(`
+        INSERT INTO ZNode (NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		nodeId, metadata.NodePort, metadata.Leader, metadata.Servers, metadata.Timestamp, metadata.Version,
+		metadata.ParentId, metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	metadata.NodeId = int(id)
+
+	var digest int64
+	err = tx.QueryRow("SELECT Digest FROM TreeDigest WHERE Id = 1").Scan(&digest)
+	if err != nil {
+		return 0, err
 	}
-	var servers []string
-	for i := 8080; i <= leaderNum; i++ {
-		servers = append(servers, strconv.Itoa(i))
+	checksum := zNodeHash(metadata)
+	next := uint64(digest) + checksum
+	_, err = tx.Exec("UPDATE ZNode SET Checksum = ?, Digest = ? WHERE NodeId = ?", int64(checksum), int64(next), id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE TreeDigest SET Digest = ? WHERE Id = 1", int64(next))
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// GetLocalState of this ZooWeeper server: its identity and view of the ensemble, never replicated
+func (zt *ZTree) GetLocalState() (*LocalState, error) {
+	row := zt.DB.QueryRow("SELECT NodePort, Leader, Servers, Observers FROM LocalState WHERE Id = 1")
+
+	var state LocalState
+	err := row.Scan(&state.NodePort, &state.Leader, &state.Servers, &state.Observers)
+	if err != nil {
+		log.Println("Error scanning LocalState:", err)
+		return nil, err
 	}
-	serversList := strings.Join(servers, ",")
+	return &state, nil
+}
 
+// InitLocalState on the first start of this ZooWeeper server, a restart keeps the existing one
+func (zt *ZTree) InitLocalState(state LocalState) error {
 	sqlStatement := `
-		UPDATE ZNode 
-		SET Leader = $1, Servers = ?
-		WHERE NodeId = "1"
-	`
-	_, err = zt.DB.Exec(sqlStatement, leader, serversList)
+	INSERT OR IGNORE INTO LocalState (Id, NodePort, Leader, Servers, Observers)
+	VALUES (1, ?, ?, ?, ?);
+`
+	_, err := zt.DB.Exec(sqlStatement, state.NodePort, state.Leader, state.Servers, state.Observers)
 	if err != nil {
-		return err
+		log.Println("Error initializing LocalState:", err)
 	}
 	return err
 }
 
+func (zt *ZTree) UpdateLeader(leader string) error {
+	_, err := zt.DB.Exec("UPDATE LocalState SET Leader = ? WHERE Id = 1", leader)
+	return err
+}
+
+// UpdateEnsemble once a Reconfig of the ensemble membership is committed
+func (zt *ZTree) UpdateEnsemble(servers, observers string) error {
+	_, err := zt.DB.Exec("UPDATE LocalState SET Servers = ?, Observers = ? WHERE Id = 1", servers, observers)
+	return err
+}
+
 func (zt *ZTree) Connection() *sql.DB {
 	return zt.DB
 }
 
+// Close the database once the ZooWeeper server shuts down
+func (zt *ZTree) Close() error {
+	return zt.DB.Close()
+}
+
+// InitializeDB by migrating it to the latest schema, refusing to start with a corrupt ZTree
 func (zt *ZTree) InitializeDB() {
-	log.Println("Creating ZNode tables")
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS ZNode (
-		NodeId INTEGER PRIMARY KEY AUTOINCREMENT,
-		NodePort TEXT,
-		Leader TEXT,
-		Servers TEXT,
-		Timestamp DATETIME,
-		Version INTEGER,
-		ParentId INTEGER,
-		Clients TEXT,
-		SenderIp TEXT,
-		ReceiverIp TEXT
-);`
-
-	_, err := zt.DB.Exec(createTableSQL)
+	err := zt.Migrate()
 	if err != nil {
 		log.Fatal("InitializeDB: ", err)
 	}
+	report, err := zt.Verify()
+	if err != nil {
+		log.Fatal("InitializeDB: ", err)
+	}
+	if !report.OK() {
+		log.Fatal("InitializeDB: corrupt ZTree, restore it from a replica: ", report.String())
+	}
 }
 
 func (zt *ZTree) ZNodeIdExists(nodeId int) (bool, error) {
@@ -173,23 +212,6 @@ func (zt *ZTree) ZNodeIdExists(nodeId int) (bool, error) {
 	return count > 0, nil
 }
 
-func (zt *ZTree) GetLocalMetadata() (*Metadata, error) {
-	row := zt.DB.QueryRow("SELECT * FROM ZNode WHERE NodeId = 1")
-
-	var data Metadata
-	err := row.Scan(
-		&data.NodeId, &data.NodePort, &data.Leader, &data.Servers,
-		&data.Timestamp, &data.Version, &data.ParentId,
-		&data.Clients, &data.SenderIp, &data.ReceiverIp,
-	)
-	if err != nil {
-		log.Println("Error scanning data:", err)
-		return nil, err
-	}
-
-	return &data, nil
-}
-
 func (zt *ZTree) getParentNodeId(senderIp string) (int, error) {
 	sqlCheck := `SELECT NodeId FROM ZNode WHERE SenderIp = ?`
 	var nodeId int
@@ -201,31 +223,21 @@ func (zt *ZTree) getParentNodeId(senderIp string) (int, error) {
 	return nodeId, nil
 }
 
-func (zt *ZTree) insertParentProcessMetadata(metadata Metadata) error {
-	sqlPartialInsert := `
-	INSERT INTO ZNode (NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
-`
-	row, err := zt.DB.Prepare(sqlPartialInsert)
-	if err != nil {
-		log.Println("Error prepare row for insertParentProcessMetadata:", err)
-		return err
-	}
-	defer row.Close()
-
-	_, err = row.Exec(
-		"", "", "", metadata.Timestamp, 0, 1,
-		metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
-	)
+func (zt *ZTree) insertParentProcessMetadata(metadata Metadata) (int, error) {
+	nodeId, err := zt.insertZNode(Metadata{
+		Timestamp:  metadata.Timestamp,
+		ParentId:   1,
+		Clients:    metadata.Clients,
+		SenderIp:   metadata.SenderIp,
+		ReceiverIp: metadata.ReceiverIp,
+	})
 	if err != nil {
 		log.Println("Error exec for insertParentProcessMetadata:", err)
-		return err
 	}
-
-	return nil
+	return nodeId, err
 }
 
-func (zt *ZTree) checkSenderClientsMatch(senderIp, clients string) (int, bool, error) {
+func (zt *ZTree) checkSenderClientsMatch(senderIp, clients string) (int, int, bool, error) {
 	// First, find the highest NodeId for the given senderIp
 	sqlGetHighestNodeId := `
         SELECT NodeId, Version 
@@ -240,11 +252,11 @@ func (zt *ZTree) checkSenderClientsMatch(senderIp, clients string) (int, bool, e
 	err := zt.DB.QueryRow(sqlGetHighestNodeId, senderIp).Scan(&highestNodeId, &version)
 	if err != nil {
 		log.Println("Error finding highest NodeId for checkSenderClientsMatch:", err)
-		return 0, false, err
+		return 0, 0, false, err
 	}
 
 	if highestNodeId == 0 {
-		return 0, false, nil
+		return 0, 0, false, nil
 	}
 
 	// Second, check if the highest NodeId also matches the given clients
@@ -256,35 +268,26 @@ func (zt *ZTree) checkSenderClientsMatch(senderIp, clients string) (int, bool, e
 	var exists int
 	err = zt.DB.QueryRow(sqlCheckClients, highestNodeId, clients).Scan(&exists)
 	if err != nil {
-		return version, false, err
+		return highestNodeId, version, false, err
 	}
 
-	return version, true, nil
+	return highestNodeId, version, true, nil
 
 }
 
-func (zt *ZTree) updateProcessMetadata(metadata Metadata, parent, version int) error {
-	sqlPartialInsert := `
-	INSERT INTO ZNode (NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
-`
-	row, err := zt.DB.Prepare(sqlPartialInsert)
-	if err != nil {
-		log.Println("Error preparing row for updateClients:", err)
-		return err
-	}
-	defer row.Close()
-
-	_, err = row.Exec(
-		"", "", "", metadata.Timestamp, version, parent,
-		metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
-	)
+func (zt *ZTree) updateProcessMetadata(metadata Metadata, parent, version int) (int, error) {
+	nodeId, err := zt.insertZNode(Metadata{
+		Timestamp:  metadata.Timestamp,
+		Version:    version,
+		ParentId:   parent,
+		Clients:    metadata.Clients,
+		SenderIp:   metadata.SenderIp,
+		ReceiverIp: metadata.ReceiverIp,
+	})
 	if err != nil {
 		log.Println("Error exec for updateClients:", err)
-		return err
 	}
-
-	return nil
+	return nodeId, err
 }
 
 func (zt *ZTree) GetHighestZNodeId() (int, error) {
@@ -331,3 +334,308 @@ func (zt *ZTree) GetMetadatasGreaterThanZNodeId(highestZNodeId int) (Metadatas,
 
 	return metadatas, nil
 }
+
+// GetRequestResult of an already committed client RequestId
+func (zt *ZTree) GetRequestResult(requestId string) (string, bool, error) {
+	var result string
+	err := zt.DB.QueryRow("SELECT Result FROM RequestLog WHERE RequestId = ?", requestId).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Println("Error querying RequestLog:", err)
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+// GetRequestLog from the oldest to the most recent RequestId
+func (zt *ZTree) GetRequestLog() ([]RequestEntry, error) {
+	rows, err := zt.DB.Query("SELECT RequestId, Result FROM RequestLog ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []RequestEntry
+	for rows.Next() {
+		var entry RequestEntry
+		if err := rows.Scan(&entry.RequestId, &entry.Result); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// InsertRequestResult of a committed client RequestId, only the most recent REQUEST_LOG_SIZE are kept
+func (zt *ZTree) InsertRequestResult(requestId, result string) error {
+	_, err := zt.DB.Exec("INSERT OR REPLACE INTO RequestLog (RequestId, Result) VALUES (?, ?)", requestId, result)
+	if err != nil {
+		log.Println("Error inserting RequestLog:", err)
+		return err
+	}
+
+	_, err = zt.DB.Exec("DELETE FROM RequestLog WHERE rowid <= (SELECT MAX(rowid) FROM RequestLog) - ?", REQUEST_LOG_SIZE)
+	return err
+}
+
+// GetPurgedZxid is the highest NodeId ever purged by PurgeHistory or PurgeZNodes
+func (zt *ZTree) GetPurgedZxid() (int, error) {
+	var purgedZxid int
+	err := zt.DB.QueryRow("SELECT PurgedZxid FROM Retention WHERE Id = 1").Scan(&purgedZxid)
+	return purgedZxid, err
+}
+
+// PurgeHistory of superseded versions outside the retention, returning the NodeId of the purged ZNode
+func (zt *ZTree) PurgeHistory(keepVersions int, before time.Time) ([]int, error) {
+	metadatas, err := zt.AllMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Metadata
+	for _, metadata := range metadatas {
+		nodes = append(nodes, *metadata)
+	}
+	purged := supersededVersions(nodes, keepVersions, before)
+	if len(purged) == 0 {
+		return nil, nil
+	}
+	return purged, zt.PurgeZNodes(purged)
+}
+
+// PurgeZNodes by NodeId as purged by the Leader, skipping the ones this server does not have
+func (zt *ZTree) PurgeZNodes(nodeIds []int) error {
+	if len(nodeIds) == 0 {
+		return nil
+	}
+	tx, err := zt.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The Checksum of a purged ZNode moves to the PurgedDigest, leaving the Digest of the ZTree as is
+	var purgedDigest int64
+	err = tx.QueryRow("SELECT PurgedDigest FROM TreeDigest WHERE Id = 1").Scan(&purgedDigest)
+	if err != nil {
+		return err
+	}
+	purgedZxid := 0
+	for _, nodeId := range nodeIds {
+		if nodeId > purgedZxid {
+			purgedZxid = nodeId
+		}
+		var checksum int64
+		err = tx.QueryRow("SELECT Checksum FROM ZNode WHERE NodeId = ?", nodeId).Scan(&checksum)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Println("Error purging ZNode:", err)
+			return err
+		}
+		purgedDigest = int64(uint64(purgedDigest) + uint64(checksum))
+		_, err = tx.Exec("DELETE FROM ZNode WHERE NodeId = ?", nodeId)
+		if err != nil {
+			log.Println("Error purging ZNode:", err)
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE Retention SET PurgedZxid = MAX(PurgedZxid, ?) WHERE Id = 1", purgedZxid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE TreeDigest SET PurgedDigest = ? WHERE Id = 1", purgedDigest)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestoreSnapshot replaces every ZNode by the ones of the Snapshot, once its digest is verified
+func (zt *ZTree) RestoreSnapshot(snapshot Snapshot) error {
+	digest, err := snapshot.verify()
+	if err != nil {
+		return err
+	}
+
+	tx, err := zt.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM ZNode")
+	if err != nil {
+		return err
+	}
+	for _, metadata := range snapshot.MetadataList {
+		_, err = tx.Exec(`
+		INSERT INTO ZNode (NodeId, NodePort, Leader, Servers, Timestamp, Version, ParentId, Clients, SenderIp, ReceiverIp, Checksum, Digest)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			metadata.NodeId, metadata.NodePort, metadata.Leader, metadata.Servers, metadata.Timestamp,
+			metadata.Version, metadata.ParentId, metadata.Clients, metadata.SenderIp, metadata.ReceiverIp,
+			int64(zNodeHash(metadata)), int64(snapshot.Digests[metadata.NodeId]),
+		)
+		if err != nil {
+			log.Println("Error restoring ZNode:", err)
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE Retention SET PurgedZxid = ? WHERE Id = 1", snapshot.PurgedZxid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE TreeDigest SET Digest = ?, PurgedDigest = ? WHERE Id = 1", int64(digest), int64(snapshot.PurgedDigest))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSnapshot of the whole ZTree, with the Digest at each zxid
+func (zt *ZTree) GetSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{Digests: make(map[int]uint64)}
+	treeDigest, err := zt.GetDigest()
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.PurgedDigest = treeDigest.PurgedDigest
+	snapshot.PurgedZxid, err = zt.GetPurgedZxid()
+	if err != nil {
+		return snapshot, err
+	}
+
+	rows, err := zt.DB.Query("SELECT " + zNodeColumns + ", Digest FROM ZNode ORDER BY NodeId")
+	if err != nil {
+		return snapshot, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data Metadata
+		var digest int64
+		err := rows.Scan(
+			&data.NodeId, &data.NodePort, &data.Leader, &data.Servers,
+			&data.Timestamp, &data.Version, &data.ParentId,
+			&data.Clients, &data.SenderIp, &data.ReceiverIp, &digest,
+		)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.MetadataList = append(snapshot.MetadataList, data)
+		snapshot.Digests[data.NodeId] = uint64(digest)
+	}
+	return snapshot, rows.Err()
+}
+
+// GetDigest of the ZTree at its highest zxid, read in one statement so a concurrent write can not come in between
+func (zt *ZTree) GetDigest() (TreeDigest, error) {
+	var treeDigest TreeDigest
+	var digest, purgedDigest int64
+	err := zt.DB.QueryRow(`
+		SELECT Digest, PurgedDigest, (SELECT IFNULL(MAX(NodeId), 0) FROM ZNode)
+		FROM TreeDigest WHERE Id = 1`,
+	).Scan(&digest, &purgedDigest, &treeDigest.Zxid)
+	if err != nil {
+		return treeDigest, err
+	}
+	treeDigest.Digest = uint64(digest)
+	treeDigest.PurgedDigest = uint64(purgedDigest)
+	return treeDigest, nil
+}
+
+// GetDigestAt a zxid, false if this ZNode is missing or purged
+func (zt *ZTree) GetDigestAt(zxid int) (uint64, bool, error) {
+	var digest sql.NullInt64
+	err := zt.DB.QueryRow("SELECT Digest FROM ZNode WHERE NodeId = ?", zxid).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(digest.Int64), digest.Valid, nil
+}
+
+// Verify the Checksum of every ZNode and the Digest of the ZTree
+func (zt *ZTree) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	treeDigest, err := zt.GetDigest()
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := zt.DB.Query("SELECT " + zNodeColumns + ", Checksum, Digest FROM ZNode ORDER BY NodeId")
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	var nodes []Metadata
+	var highestDigest uint64
+	for rows.Next() {
+		var data Metadata
+		var checksum, digest sql.NullInt64
+		err := rows.Scan(
+			&data.NodeId, &data.NodePort, &data.Leader, &data.Servers,
+			&data.Timestamp, &data.Version, &data.ParentId,
+			&data.Clients, &data.SenderIp, &data.ReceiverIp, &checksum, &digest,
+		)
+		if err != nil {
+			return report, err
+		}
+		if !checksum.Valid || !digest.Valid {
+			report.problem("ZNode %d has no checksum, it was not written by ZooWeeper", data.NodeId)
+		} else if hash := zNodeHash(data); uint64(checksum.Int64) != hash {
+			report.problem("ZNode %d checksum %016x does not match its content %016x", data.NodeId, uint64(checksum.Int64), hash)
+		}
+		nodes = append(nodes, data)
+		highestDigest = uint64(digest.Int64)
+	}
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+
+	verifyNodes(&report, nodes, treeDigest, highestDigest)
+	return report, nil
+}
+
+// GetHistory of the process ZNode of a client: all its versions not yet purged, by increasing NodeId
+func (zt *ZTree) GetHistory(senderIp string) ([]Metadata, error) {
+	rows, err := zt.DB.Query("SELECT "+zNodeColumns+" FROM ZNode WHERE SenderIp = ? ORDER BY NodeId", senderIp)
+	if err != nil {
+		log.Println("Error querying the history:", err)
+		return nil, err
+	}
+	return scanMetadatas(rows)
+}
+
+// AllMetadataAsOf a zxid, the ZTree as it was once that ZNode was committed, minus the purged versions
+func (zt *ZTree) AllMetadataAsOf(zxid int) ([]*Metadata, error) {
+	metadatas, err := zt.AllMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Metadata
+	for _, metadata := range metadatas {
+		if metadata.NodeId <= zxid {
+			results = append(results, metadata)
+		}
+	}
+	return results, nil
+}
+
+// GetZNodeIdAsOfTime is the highest NodeId written at or before asOf
+func (zt *ZTree) GetZNodeIdAsOfTime(asOf time.Time) (int, error) {
+	metadatas, err := zt.AllMetadata()
+	if err != nil {
+		return 0, err
+	}
+	var nodes []Metadata
+	for _, metadata := range metadatas {
+		nodes = append(nodes, *metadata)
+	}
+	return zNodeIdAsOfTime(nodes, asOf), nil
+}
@@ -15,4 +15,36 @@ type Metadata struct {
 
 type Metadatas struct {
 	MetadataList []Metadata `json:"MetadataList"`
+	// Digest of the sender once they are applied, to detect a divergence
+	Digest *TreeDigest `json:"Digest,omitempty"`
+	// RequestLog of the sender, so a retried Write Request is still deduplicated after a failover
+	RequestLog []RequestEntry `json:"RequestLog,omitempty"`
+	// PurgedZxid of the sender and the NodeId it retained up to it, for the receiver to purge the versions it missed
+	PurgedZxid int   `json:"PurgedZxid,omitempty"`
+	Retained   []int `json:"Retained,omitempty"`
+}
+
+// LocalState of a ZooWeeper server, see package documentation
+type LocalState struct {
+	NodePort  string `json:"NodePort"`
+	Leader    string `json:"Leader"`
+	Servers   string `json:"Servers"`
+	Observers string `json:"Observers"`
+}
+
+// Snapshot of the whole ZTree, sent instead of the missing Metadata to a Follower behind the PurgedZxid
+type Snapshot struct {
+	PurgedZxid   int        `json:"PurgedZxid"`
+	PurgedDigest uint64     `json:"PurgedDigest"`
+	MetadataList []Metadata `json:"MetadataList"`
+	// Digests of the ZTree at the zxid of each ZNode
+	Digests map[int]uint64 `json:"Digests"`
+	// RequestLog of the sender, so a retried Write Request is still deduplicated after a resync
+	RequestLog []RequestEntry `json:"RequestLog,omitempty"`
+}
+
+// RequestEntry of the RequestLog, the result of a committed client RequestId
+type RequestEntry struct {
+	RequestId string `json:"requestId"`
+	Result    string `json:"result"`
 }